@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/intervention-engine/fhir/server"
+	"github.com/synthetichealth/gofhir/synthma"
+	"gopkg.in/mgo.v2"
+)
+
+// runImport imports the resources in NDJSON files directly into the database, without running the server.  Each
+// argument is either an NDJSON file or a directory of NDJSON (*.ndjson) files.  For example:
+//
+//	gofhir import -dbname fhir output/fhir
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbName := flags.String("dbname", "fhir", "Mongo database name")
+	mongoHost := flags.String("mongohost", "localhost", "the hostname of the mongo database")
+	enableHistory := flags.Bool("history", false, "Keep prior versions of the resources updated")
+	searchParamsPath := flags.String("searchparams", "config/searchparameters", "Path to a directory of SearchParameter resources to register first")
+	pgURL := flags.String("pgurl", "", "Postgres connection URL for patient statistics (statistics are not tracked if omitted)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gofhir import [options] file-or-directory...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	session, err := mgo.Dial(*mongoHost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	config := server.DefaultConfig
+	config.DatabaseName = *dbName
+	config.EnableHistory = *enableHistory
+	config.SearchParameterPath = *searchParamsPath
+
+	// Only the interceptors are needed, since the server itself isn't run
+	s := &server.FHIRServer{Interceptors: make(map[string]server.InterceptorList)}
+	if *pgURL != "" {
+		stats, err := synthma.NewPostgresStatisticsStore(*pgURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stats.Close()
+		if err = synthma.RegisterStatisticsInterceptors(s, stats); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Custom search parameters are registered first, so their values are stored too
+	ms := server.NewMasterSession(session, config.DatabaseName)
+	server.LoadSearchParameters(ms, config)
+	importer := server.NewNDJSONImporter(server.NewMongoDataAccessLayer(ms, s.Interceptors, config))
+	var result server.ImportResult
+	for _, path := range flags.Args() {
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			err = importer.ImportDir(path, &result)
+		} else if err == nil {
+			err = importer.ImportFile(path, &result)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, importErr := range result.Errors {
+		log.Println(importErr.Error())
+	}
+	log.Printf("Imported %d resources (%d created, %d updated)\n", result.Created+result.Updated, result.Created, result.Updated)
+	if len(result.Errors) > 0 {
+		log.Fatalf("%d lines could not be imported\n", len(result.Errors))
+	}
+}
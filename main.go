@@ -2,20 +2,42 @@ package main
 
 import (
 	"flag"
+	"log"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/server"
-	_ "github.com/synthetichealth/gofhir/synthma"
+	"github.com/synthetichealth/gofhir/synthma"
 )
 
 func main() {
+	// gofhir import imports NDJSON files, rather than running the server
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+
+	// gofhir reindex recomputes the normalized search values stored with existing resources
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		runReindex(os.Args[2:])
+		return
+	}
+
 	// set up the commandline flags (-mongo and -pgurl)
 	reqLog := flag.Bool("reqlog", false, "Enables request logging -- do NOT use in production")
 	serverURL := flag.String("server", "", "The full URL for the root of the server")
 	dbName := flag.String("dbname", "fhir", "Mongo database name")
 	idxConfigPath := flag.String("idxconfig", "config/indexes.conf", "Path to the indexes config file")
+	searchParamsPath := flag.String("searchparams", "config/searchparameters", "Path to a directory of SearchParameter resources to register on startup")
 	mongoHost := flag.String("mongohost", "localhost", "the hostname of the mongo database")
+	enableHistory := flag.Bool("history", false, "Keep prior versions of resources, enabling the history and vread interactions")
+	// Storing a search writes a document for each of its results, so only searches that can't be paged by cursor, with
+	// at most server.MaxStoredSearchResults results, are stored
+	storedSearches := flag.Bool("storedsearches", false, "Store the results of searches with more than one page that can't be paged by cursor, so their pages are consistent while resources change")
+	exportPath := flag.String("exportpath", "exports", "Path to the directory bulk data $export files are written to")
 	readOnly := flag.Bool("readonly", false, "Run the API in read-only mode (no creates, updates, or deletes allowed)")
+	pgURL := flag.String("pgurl", "", "Postgres connection URL for patient statistics (statistics are not tracked if omitted)")
 
 	flag.Parse()
 
@@ -36,6 +58,17 @@ func main() {
 		config.IndexConfigPath = *idxConfigPath
 	}
 
+	if *searchParamsPath != "" {
+		config.SearchParameterPath = *searchParamsPath
+	}
+
+	config.EnableHistory = *enableHistory
+	config.EnableStoredSearches = *storedSearches
+
+	if *exportPath != "" {
+		config.ExportPath = *exportPath
+	}
+
 	if *reqLog {
 		s.Engine.Use(server.RequestLoggerHandler)
 	}
@@ -44,9 +77,38 @@ func main() {
 		s.Engine.Use(ReadOnlyHandler)
 	}
 
+	if *pgURL != "" {
+		stats, err := synthma.NewPostgresStatisticsStore(*pgURL)
+		if err != nil {
+			panic(err)
+		}
+		defer stats.Close()
+		log.Println("Connected to postgres")
+
+		if err = synthma.RegisterStatisticsInterceptors(s, stats); err != nil {
+			panic(err)
+		}
+		synthma.RegisterStatisticsRoutes(s, stats)
+		go refreshAgeBands(stats)
+	}
+
 	s.Run(config)
 }
 
+// refreshAgeBands moves patients into their new age bands as they get older, on startup and then
+// once a day.
+func refreshAgeBands(stats *synthma.PostgresStatisticsStore) {
+	for {
+		moved, err := stats.RefreshAgeBands(time.Now())
+		if err != nil {
+			log.Printf("Error refreshing age bands: %s\n", err)
+		} else if moved > 0 {
+			log.Printf("Moved %d patients into new age bands\n", moved)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
 // ReadOnlyHandler makes the API read-only and responds to any requests that are not
 // GET, HEAD, or OPTIONS with a 403 Forbidden error.
 func ReadOnlyHandler(c *gin.Context) {
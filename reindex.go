@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+)
+
+// runReindex recomputes the normalized search values stored with every resource in the database, without running
+// the server.  Values missing from resources saved by earlier versions of the server are stored on startup, so this is
+// only needed when the way the values are computed changes.  For example:
+//
+//	gofhir reindex -dbname fhir
+func runReindex(args []string) {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	dbName := flags.String("dbname", "fhir", "Mongo database name")
+	mongoHost := flags.String("mongohost", "localhost", "the hostname of the mongo database")
+	searchParamsPath := flags.String("searchparams", "config/searchparameters", "Path to a directory of SearchParameter resources to register first")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gofhir reindex [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	session, err := mgo.Dial(*mongoHost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	config := server.DefaultConfig
+	config.DatabaseName = *dbName
+	config.SearchParameterPath = *searchParamsPath
+
+	// Custom search parameters are registered first, so their values are stored too
+	ms := server.NewMasterSession(session, config.DatabaseName)
+	server.LoadSearchParameters(ms, config)
+
+	worker := ms.GetWorkerSession()
+	defer worker.Close()
+	count, err := server.ReindexNormalizedValues(worker.DB())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Reindexed %d resources\n", count)
+}
@@ -0,0 +1,157 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestBatchSuite(t *testing.T) {
+	suite.Run(t, new(BatchSuite))
+}
+
+type BatchSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *BatchSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *BatchSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *BatchSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *BatchSuite) TestEntryOutcomes() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id, err := suite.dal.Post(&models.Patient{Gender: "male"})
+	require.NoError(err)
+	_, err = suite.dal.Post(&models.Patient{Gender: "female"})
+	require.NoError(err)
+	_, err = suite.dal.Post(&models.Patient{Gender: "female"})
+	require.NoError(err)
+
+	bundle := fmt.Sprintf(`{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [{
+			"resource": {"resourceType": "Patient", "gender": "other"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "other"},
+			"request": {"method": "POST", "url": "Patient"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "unknown"},
+			"request": {"method": "PUT", "url": "Patient/%s", "ifMatch": "W/\"2\""}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "unknown"},
+			"request": {"method": "PUT", "url": "Patient?gender=female"}
+		}, {
+			"request": {"method": "PATCH", "url": "Patient/%s"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "female"},
+			"request": {"method": "PUT", "url": "Patient/%s"}
+		}]
+	}`, id, id, id)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/", bytes.NewBufferString(bundle))
+	r.Header.Set("Content-Type", "application/json")
+	suite.handler.ServeHTTP(w, r)
+
+	require.Equal(http.StatusOK, w.Code)
+	response := new(models.Bundle)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	assert.Equal("batch-response", response.Type)
+	require.Len(response.Entry, 6)
+
+	for i, status := range []string{"400", "201", "412", "412", "501", "200"} {
+		require.NotNil(response.Entry[i].Response, i)
+		assert.Equal(status, response.Entry[i].Response.Status, i)
+		if status[0] == '2' {
+			assert.Nil(response.Entry[i].Response.Outcome, i)
+			continue
+		}
+		require.IsType(&models.OperationOutcome{}, response.Entry[i].Response.Outcome, i)
+		outcome := response.Entry[i].Response.Outcome.(*models.OperationOutcome)
+		assert.Equal([]string{fmt.Sprintf("Bundle.entry[%d]", i)}, outcome.Issue[0].Location)
+	}
+
+	// The successful entries were processed
+	result, err := suite.dal.Get(id, "Patient")
+	require.NoError(err)
+	assert.Equal("female", result.(*models.Patient).Gender)
+	n, err := server.Database.C("patients").Count()
+	require.NoError(err)
+	assert.Equal(4, n)
+}
+
+func (suite *BatchSuite) TestReadEntries() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id, err := suite.dal.Post(&models.Patient{Gender: "male"})
+	require.NoError(err)
+	_, err = suite.dal.Post(&models.Condition{Subject: &models.Reference{Reference: "Patient/" + id, Type: "Patient", ReferencedID: id}})
+	require.NoError(err)
+
+	bundle := fmt.Sprintf(`{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{"request": {"method": "GET", "url": "Patient/%[1]s"}},
+			{"request": {"method": "GET", "url": "Patient/%[1]s/_history/1"}},
+			{"request": {"method": "GET", "url": "Patient?gender=male"}},
+			{"request": {"method": "GET", "url": "Patient/%[1]s/$everything"}},
+			{"request": {"method": "HEAD", "url": "http://example.com/Patient/%[1]s"}},
+			{"request": {"method": "GET", "url": "Patient/%[1]s", "ifNoneMatch": "W/\"1\""}},
+			{"request": {"method": "GET", "url": "Patient/57ec3d291445d4449de25da2"}},
+			{"request": {"method": "GET", "url": "Foo/%[1]s"}}
+		]
+	}`, id)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/", bytes.NewBufferString(bundle))
+	r.Header.Set("Content-Type", "application/json")
+	suite.handler.ServeHTTP(w, r)
+
+	require.Equal(http.StatusOK, w.Code)
+	response := new(models.Bundle)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	require.Len(response.Entry, 8)
+
+	for i, status := range []string{"200", "200", "200", "200", "200", "304", "404", "404"} {
+		require.NotNil(response.Entry[i].Response, i)
+		assert.Equal(status, response.Entry[i].Response.Status, i)
+	}
+
+	require.IsType(&models.Patient{}, response.Entry[0].Resource)
+	assert.Equal(id, response.Entry[0].Resource.(*models.Patient).Id)
+	assert.Equal(`W/"1"`, response.Entry[0].Response.Etag)
+	assert.Equal("http://example.com/Patient/"+id, response.Entry[0].FullUrl)
+	assert.IsType(&models.Patient{}, response.Entry[1].Resource)
+
+	require.IsType(&models.Bundle{}, response.Entry[2].Resource)
+	assert.Equal("searchset", response.Entry[2].Resource.(*models.Bundle).Type)
+	assert.Len(response.Entry[2].Resource.(*models.Bundle).Entry, 1)
+	require.IsType(&models.Bundle{}, response.Entry[3].Resource)
+	assert.Len(response.Entry[3].Resource.(*models.Bundle).Entry, 2)
+
+	// HEAD and not modified entries have no resource
+	assert.Nil(response.Entry[4].Resource)
+	assert.Equal(`W/"1"`, response.Entry[4].Response.Etag)
+	assert.Nil(response.Entry[5].Resource)
+}
@@ -0,0 +1,130 @@
+package synthma
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestCompositeSuite(t *testing.T) {
+	suite.Run(t, new(CompositeSuite))
+}
+
+type CompositeSuite struct {
+	testutil.MongoSuite
+}
+
+func (suite *CompositeSuite) SetupTest() {
+	require := suite.Require()
+	server.Database = suite.DB()
+
+	require.NoError(server.Database.C("observations").Insert(
+		// High systolic, normal diastolic
+		bloodPressure("1", 150, 80),
+		// Normal systolic, high diastolic
+		bloodPressure("2", 120, 95),
+		&models.Observation{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "3"}},
+			Code:           loinc("8480-6"),
+			ValueQuantity:  mmHg(145),
+		},
+		&models.Observation{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "4"}},
+			Code:           loinc("8302-2"),
+			ValueQuantity:  &models.Quantity{Value: float64Ptr(180), Unit: "cm"},
+			Related: []models.ObservationRelatedComponent{
+				{Type: "derived-from", Target: &models.Reference{Reference: "Observation/1", ReferencedID: "1", Type: "Observation"}},
+				{Type: "has-member", Target: &models.Reference{Reference: "Observation/2", ReferencedID: "2", Type: "Observation"}},
+			},
+		},
+	))
+}
+
+func (suite *CompositeSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *CompositeSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *CompositeSuite) TestComponentCodeValueQuantity() {
+	// The code and value must be in the same component
+	suite.assertIDs("component-code-value-quantity=http://loinc.org|8480-6$gt140", "1")
+	suite.assertIDs("component-code-value-quantity=http://loinc.org|8462-4$gt90", "2")
+	suite.assertIDs("component-code-value-quantity=8462-4$gt90|http://unitsofmeasure.org|mm[Hg]", "2")
+	suite.assertIDs("component-code-value-quantity=8462-4$gt100")
+	suite.assertIDs("component-code-value-quantity=http://loinc.org|8480-6$gt140,http://loinc.org|8462-4$gt90", "1", "2")
+	suite.assertIDs("component-code-value-quantity=http://loinc.org|8480-6$gt140&component-code-value-quantity=http://loinc.org|8462-4$lt90", "1")
+}
+
+func (suite *CompositeSuite) TestCodeValueQuantity() {
+	// The code and value may be the observation's or one of its components'
+	suite.assertIDs("code-value-quantity=http://loinc.org|8480-6$gt140", "1", "3")
+	suite.assertIDs("code-value-quantity=http://loinc.org|8302-2$ge180", "4")
+	suite.assertIDs("code-value-quantity=http://loinc.org|8302-2$gt180")
+	// A value of another code doesn't match
+	suite.assertIDs("code-value-quantity=http://loinc.org|55284-4$gt140")
+}
+
+func (suite *CompositeSuite) TestRelated() {
+	suite.assertIDs("related=Observation/2$has-member", "4")
+	suite.assertIDs("related=Observation/1$has-member")
+}
+
+func (suite *CompositeSuite) TestInvalid() {
+	suite.assertInvalid("component-code-value-quantity=http://loinc.org|8480-6")
+	suite.assertInvalid("component-code-value-quantity=http://loinc.org|8480-6$gt140$mm[Hg]")
+	suite.assertInvalid("component-code-value-quantity:missing=true")
+}
+
+func (suite *CompositeSuite) assertIDs(query string, expected ...string) {
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: "Observation", Query: query}
+	err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Sort("_id").All(&results)
+	suite.Require().NoError(err)
+	IDs := make([]string, 0, len(results))
+	for _, result := range results {
+		IDs = append(IDs, result.ID)
+	}
+	if expected == nil {
+		expected = []string{}
+	}
+	suite.Assert().Equal(expected, IDs, query)
+}
+
+func (suite *CompositeSuite) assertInvalid(query string) {
+	q := search.Query{Resource: "Observation", Query: query}
+	suite.Assert().Panics(func() {
+		search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q)
+	}, query)
+}
+
+func bloodPressure(id string, systolic, diastolic float64) *models.Observation {
+	return &models.Observation{
+		DomainResource: models.DomainResource{Resource: models.Resource{Id: id}},
+		Code:           loinc("55284-4"),
+		Component: []models.ObservationComponentComponent{
+			{Code: loinc("8480-6"), ValueQuantity: mmHg(systolic)},
+			{Code: loinc("8462-4"), ValueQuantity: mmHg(diastolic)},
+		},
+	}
+}
+
+func loinc(code string) *models.CodeableConcept {
+	return &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: code}}}
+}
+
+func mmHg(value float64) *models.Quantity {
+	return &models.Quantity{Value: &value, Unit: "mmHg", System: "http://unitsofmeasure.org", Code: "mm[Hg]"}
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
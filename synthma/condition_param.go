@@ -3,7 +3,6 @@ package synthma
 import (
 	"errors"
 
-	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/search"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -12,14 +11,29 @@ func init() {
 	// Register the condition-code parameter
 	search.GlobalRegistry().RegisterParameterInfo(ConditionCodeParamInfo)
 	search.GlobalRegistry().RegisterParameterParser(ConditionCodeParamInfo.Type, ConditionCodeParamParser)
-	search.GlobalMongoRegistry().RegisterBSONBuilder(ConditionCodeParamInfo.Type, ConditionCodeBSONBuilder)
+	search.GlobalMongoRegistry().RegisterPipelineBuilder(ConditionCodeParamInfo.Type, ConditionCodePipelineBuilder)
+	search.GlobalMongoRegistry().RegisterSourceBuilder(ConditionCodeParamInfo.Type, ConditionCodeSourceBuilder)
+
+	// Register the condition-code-status parameter
+	search.GlobalRegistry().RegisterParameterInfo(ConditionCodeStatusParamInfo)
+	search.GlobalRegistry().RegisterParameterParser(ConditionCodeStatusParamInfo.Type, ConditionCodeStatusParamParser)
+	search.GlobalMongoRegistry().RegisterPipelineBuilder(ConditionCodeStatusParamInfo.Type, ConditionCodePipelineBuilder)
+	search.GlobalMongoRegistry().RegisterSourceBuilder(ConditionCodeStatusParamInfo.Type, ConditionCodeSourceBuilder)
 }
 
-// ConditionCodeParam represents the condition-code search parameter. Patient's may be searched
-// by conditions they have using a combination of system and code. This behaves exactly the same
-// as a standard TokenParam. See: http://hl7.org/fhir/2016Sep/search.html#token
+// ConditionCodeParam represents the condition-code and condition-code-status search parameters.
+// Patient's may be searched by conditions they have using one or more comma-separated (OR'd)
+// values. For condition-code, each value behaves exactly the same as a standard TokenParam, so
+// a system|code value only matches codes from that system. See:
+// http://hl7.org/fhir/2016Sep/search.html#token
+//
+// The :not modifier matches patients having none of the conditions, and the :text modifier
+// (condition-code only) matches the start of the condition's text or coding display, ignoring case.
+//
+// Each Item is a *search.TokenParam (condition-code), a *search.StringParam (condition-code:text),
+// or a *search.CompositeParam of [system|]code and clinical status (condition-code-status).
 type ConditionCodeParam struct {
-	search.TokenParam
+	search.OrParam
 }
 
 // ConditionCodeParamInfo represents the condition-code for Patients' conditions. This allows
@@ -30,40 +44,100 @@ var ConditionCodeParamInfo = search.SearchParamInfo{
 	Type:     "synthma.patient_condition_code",
 }
 
+// ConditionCodeStatusParamInfo represents the condition-code and clinical status for Patients'
+// conditions, as a composite value (e.g., http://snomed.info/sct|44054006$active). This allows
+// patients to be searched by conditions they have with a given clinical status.
+var ConditionCodeStatusParamInfo = search.SearchParamInfo{
+	Resource: "Patient",
+	Name:     "condition-code-status",
+	Type:     "synthma.patient_condition_code_status",
+}
+
 // ConditionCodeParamParser parses the parameter and returns a ConditionCodeParam.
 var ConditionCodeParamParser = func(info search.SearchParamInfo, data search.SearchParamData) (search.SearchParam, error) {
+	items, err := parseCodeItems(info, data)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ConditionCodeParam{
-		TokenParam: *search.ParseTokenParam(data.Value, info),
+		OrParam: search.OrParam{SearchParamInfo: info, Items: items},
 	}, nil
 }
 
-// ConditionCodeBSONBuilder builds the Mongo BSON object corresponding to the query by Patient condition.
-var ConditionCodeBSONBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) (object bson.M, err error) {
+// ConditionCodeStatusParamParser parses the parameter and returns a ConditionCodeParam.
+var ConditionCodeStatusParamParser = func(info search.SearchParamInfo, data search.SearchParamData) (search.SearchParam, error) {
+	if data.Modifier != "" && data.Modifier != "not" {
+		return nil, unsupportedModifierError(info)
+	}
 
-	cc, ok := param.(*ConditionCodeParam)
-	if !ok {
-		return nil, errors.New("Expected a ConditionCodeParam")
+	values := search.SplitParamValue(data.Value, ',')
+	items := make([]search.SearchParam, len(values))
+	for i, value := range values {
+		composite := search.ParseCompositeParam(value, info)
+		if len(composite.CompositeValues) != 2 || composite.CompositeValues[0] == "" || composite.CompositeValues[1] == "" {
+			return nil, invalidParamError(info, "must be of the form [system|]code$status")
+		}
+		items[i] = composite
 	}
 
-	// First get a list of patient IDs for this condition
-	var subjectWrappers []struct {
-		Subject *models.Reference `bson:"subject,omitempty"`
+	return &ConditionCodeParam{
+		OrParam: search.OrParam{SearchParamInfo: info, Items: items},
+	}, nil
+}
+
+// conditionJoin describes how conditions reference their patients.
+var conditionJoin = patientJoin{Collection: "conditions", PatientField: "subject"}
+
+// ConditionCodeSourceBuilder builds the pipeline source corresponding to the query by Patient
+// condition.  The matching conditions are found first (using the indexes on their codes), and then
+// their patients are looked up, so the cost of the query depends on the number of matching
+// conditions rather than the number of patients.  Queries using the :not modifier can't be
+// found this way, and use ConditionCodePipelineBuilder instead.
+var ConditionCodeSourceBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) (*search.PipelineSource, error) {
+	ors, not, err := conditionCodeOrs(param)
+	if err != nil {
+		return nil, err
 	}
-	if err := searcher.GetDB().C("conditions").Find(bson.M{"code.coding.code": cc.Code}).Select(bson.M{"_id": 0, "subject": 1}).All(&subjectWrappers); err != nil {
+	return conditionJoin.source(ors, not), nil
+}
+
+// ConditionCodePipelineBuilder builds the aggregation pipeline stages corresponding to the query by
+// Patient condition, when the query can't be found using ConditionCodeSourceBuilder (or another
+// parameter's source is used instead).  Each patient's conditions are joined (using the index on
+// subject.referenceid) and matched in place, so the query never has to materialize the set of
+// matching patient IDs.
+var ConditionCodePipelineBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) ([]bson.M, error) {
+	ors, not, err := conditionCodeOrs(param)
+	if err != nil {
 		return nil, err
 	}
+	return conditionJoin.stages(ors, not), nil
+}
 
-	patientIds := []string{}
-	for _, wrapper := range subjectWrappers {
-		if wrapper.Subject.Type == "Patient" {
-			patientIds = append(patientIds, wrapper.Subject.ReferencedID)
+// conditionCodeOrs returns the criteria for conditions matching each of the values of a
+// ConditionCodeParam, and whether the patients must have none of them.
+func conditionCodeOrs(param search.SearchParam) (ors []bson.M, not bool, err error) {
+	cc, ok := param.(*ConditionCodeParam)
+	if !ok {
+		return nil, false, errors.New("Expected a ConditionCodeParam")
+	}
+
+	ors = make([]bson.M, len(cc.Items))
+	for i, item := range cc.Items {
+		if ors[i], err = conditionCriteria(item); err != nil {
+			return nil, false, err
 		}
 	}
+	return ors, cc.Modifier == "not", nil
+}
 
-	// Return a BSON object (for Patient) indicating the set of Patient IDs that should be used
-	return bson.M{
-		"_id": bson.M{
-			"$in": patientIds,
-		},
-	}, nil
+// conditionCriteria returns the conditions query matching a single item of a ConditionCodeParam.
+func conditionCriteria(item search.SearchParam) (bson.M, error) {
+	if composite, ok := item.(*search.CompositeParam); ok {
+		criteria := codingCriteria("code", search.ParseTokenParam(composite.CompositeValues[0], composite.SearchParamInfo))
+		criteria["clinicalStatus"] = composite.CompositeValues[1]
+		return criteria, nil
+	}
+	return codeCriteria("code", item)
 }
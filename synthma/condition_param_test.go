@@ -1,6 +1,7 @@
 package synthma
 
 import (
+	"sort"
 	"testing"
 
 	"gopkg.in/mgo.v2/bson"
@@ -41,7 +42,10 @@ func (suite *ConditionCodeParamSuite) TestConditionCodeParamParserCodeOnly() {
 	p, err := ConditionCodeParamParser(ConditionCodeParamInfo, search.SearchParamData{Value: "60004576"})
 	require.NoError(err)
 	assert.IsType(new(ConditionCodeParam), p)
-	assert.Equal("60004576", p.(*ConditionCodeParam).Code)
+	require.Len(p.(*ConditionCodeParam).Items, 1)
+	token := p.(*ConditionCodeParam).Items[0].(*search.TokenParam)
+	assert.True(token.AnySystem)
+	assert.Equal("60004576", token.Code)
 }
 
 func (suite *ConditionCodeParamSuite) TestConditionCodeParamParserSystemAndCode() {
@@ -51,32 +55,311 @@ func (suite *ConditionCodeParamSuite) TestConditionCodeParamParserSystemAndCode(
 	p, err := ConditionCodeParamParser(ConditionCodeParamInfo, search.SearchParamData{Value: "http://snomed.info/sct|60004576"})
 	require.NoError(err)
 	assert.IsType(new(ConditionCodeParam), p)
-	assert.Equal("http://snomed.info/sct", p.(*ConditionCodeParam).System)
-	assert.Equal("60004576", p.(*ConditionCodeParam).Code)
+	require.Len(p.(*ConditionCodeParam).Items, 1)
+	token := p.(*ConditionCodeParam).Items[0].(*search.TokenParam)
+	assert.Equal("http://snomed.info/sct", token.System)
+	assert.Equal("60004576", token.Code)
 }
 
-func (suite *ConditionCodeParamSuite) TestConditionCodeBSONBuilder() {
+func (suite *ConditionCodeParamSuite) TestConditionCodeParamParserOrValues() {
 	require := suite.Require()
 	assert := suite.Assert()
 
-	// Load some conditions into the database
-	conditions := make([]models.Condition, 4)
-	suite.InsertFixture("conditions", "../fixtures/conditions.json", &conditions)
+	p, err := ConditionCodeParamParser(ConditionCodeParamInfo, search.SearchParamData{Value: "http://snomed.info/sct|60004576,44465007"})
+	require.NoError(err)
+	items := p.(*ConditionCodeParam).Items
+	require.Len(items, 2)
+	assert.Equal("http://snomed.info/sct", items[0].(*search.TokenParam).System)
+	assert.Equal("60004576", items[0].(*search.TokenParam).Code)
+	assert.True(items[1].(*search.TokenParam).AnySystem)
+	assert.Equal("44465007", items[1].(*search.TokenParam).Code)
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeParamParserUnsupportedModifier() {
+	info := ConditionCodeParamInfo
+	info.Modifier = "exact"
+	_, err := ConditionCodeParamParser(info, search.SearchParamData{Modifier: "exact", Value: "60004576"})
+	suite.Error(err)
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeStatusParamParser() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	p, err := ConditionCodeStatusParamParser(ConditionCodeStatusParamInfo, search.SearchParamData{Value: "http://snomed.info/sct|60004576$active"})
+	require.NoError(err)
+	require.Len(p.(*ConditionCodeParam).Items, 1)
+	assert.Equal([]string{"http://snomed.info/sct|60004576", "active"}, p.(*ConditionCodeParam).Items[0].(*search.CompositeParam).CompositeValues)
+
+	_, err = ConditionCodeStatusParamParser(ConditionCodeStatusParamInfo, search.SearchParamData{Value: "60004576"})
+	assert.Error(err)
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodePipelineBuilder() {
+	require := suite.Require()
+	assert := suite.Assert()
 
 	// Create the search parameter
 	// 62106007 = Concussion, no loss of consciousness
-	param, err := ConditionCodeParamParser(ConditionCodeParamInfo, search.SearchParamData{Value: "62106007"})
+	param, err := ConditionCodeParamParser(ConditionCodeParamInfo, search.SearchParamData{Value: "http://snomed.info/sct|62106007"})
 	require.NoError(err)
 
-	// Run the BSON builder
-	obtained, err := ConditionCodeBSONBuilder(param, search.NewMongoSearcher(server.Database))
+	// Run the pipeline builder
+	obtained, err := ConditionCodePipelineBuilder(param, search.NewMongoSearcher(server.Database))
 	require.NoError(err)
 
-	// Check the BSON obtained
-	expected := bson.M{
-		"_id": bson.M{
-			"$in": []string{"57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2", "57ef3d291445d4449de25da2"},
-		},
+	// Check the stages obtained
+	expected := []bson.M{
+		{"$lookup": bson.M{
+			"from":         "conditions",
+			"localField":   "_id",
+			"foreignField": "subject.referenceid",
+			"as":           "_synthmaConditions",
+		}},
+		{"$match": bson.M{
+			"_synthmaConditions": bson.M{
+				"$elemMatch": bson.M{
+					"code.coding":  bson.M{"$elemMatch": bson.M{"system": "http://snomed.info/sct", "code": "62106007"}},
+					"subject.type": "Patient",
+				},
+			},
+		}},
+		{"$project": bson.M{"_synthmaConditions": 0}},
 	}
 	assert.Equal(expected, obtained)
 }
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSourceBuilder() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// 62106007 = Concussion, no loss of consciousness
+	param, err := ConditionCodeParamParser(ConditionCodeParamInfo, search.SearchParamData{Value: "http://snomed.info/sct|62106007"})
+	require.NoError(err)
+
+	source, err := ConditionCodeSourceBuilder(param, search.NewMongoSearcher(server.Database))
+	require.NoError(err)
+	require.NotNil(source)
+
+	// The conditions are matched first, rather than joining every patient's conditions
+	assert.Equal("conditions", source.Collection)
+	expected := []bson.M{
+		{"$match": bson.M{
+			"code.coding":  bson.M{"$elemMatch": bson.M{"system": "http://snomed.info/sct", "code": "62106007"}},
+			"subject.type": "Patient",
+		}},
+		{"$group": bson.M{"_id": "$subject.referenceid"}},
+		{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "_synthmaPatient",
+		}},
+		{"$unwind": "$_synthmaPatient"},
+		{"$replaceRoot": bson.M{"newRoot": "$_synthmaPatient"}},
+	}
+	assert.Equal(expected, source.Stages)
+
+	// Patients without the condition can't be found from the conditions
+	info := ConditionCodeParamInfo
+	info.Modifier = "not"
+	param, err = ConditionCodeParamParser(info, search.SearchParamData{Modifier: "not", Value: "62106007"})
+	require.NoError(err)
+	source, err = ConditionCodeSourceBuilder(param, search.NewMongoSearcher(server.Database))
+	require.NoError(err)
+	assert.Nil(source)
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearch() {
+	suite.insertFixtures()
+
+	// 62106007 = Concussion, no loss of consciousness
+	suite.assertPatientIDs("condition-code=62106007", "57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2", "57ef3d291445d4449de25da2")
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearchHonorsSystem() {
+	suite.insertFixtures()
+
+	// 44465007 = Sprain of ankle, but the same code is also used in a local code system
+	suite.assertPatientIDs("condition-code=http://snomed.info/sct|44465007", "57eg3d291445d4449de25da2")
+	suite.assertPatientIDs("condition-code=http://example.org/local-codes|44465007", "57eh3d291445d4449de25da2")
+	suite.assertPatientIDs("condition-code=44465007", "57eg3d291445d4449de25da2", "57eh3d291445d4449de25da2")
+	suite.assertPatientIDs("condition-code=http://loinc.org|44465007")
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearchOrValues() {
+	suite.insertFixtures()
+
+	suite.assertPatientIDs("condition-code=http://snomed.info/sct|44465007,http://example.org/local-codes|44465007",
+		"57eg3d291445d4449de25da2", "57eh3d291445d4449de25da2")
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearchNot() {
+	suite.insertFixtures()
+
+	suite.assertPatientIDs("condition-code:not=62106007,http://example.org/local-codes|44465007",
+		"57eg3d291445d4449de25da2", "57ei3d291445d4449de25da2")
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearchText() {
+	suite.insertFixtures()
+
+	suite.assertPatientIDs("condition-code:text=sprain", "57eg3d291445d4449de25da2")
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeStatusSearch() {
+	suite.insertFixtures()
+
+	suite.assertPatientIDs("condition-code-status=http://snomed.info/sct|62106007$active", "57ef3d291445d4449de25da2")
+	suite.assertPatientIDs("condition-code-status=62106007$resolved,44465007$active",
+		"57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2", "57eg3d291445d4449de25da2", "57eh3d291445d4449de25da2")
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearchCombinedWithOtherParams() {
+	suite.insertFixtures()
+
+	suite.assertPatientIDs("condition-code=62106007&_id=57ed3d291445d4449de25da2", "57ed3d291445d4449de25da2")
+	// Only the first parameter is found from the conditions; the second joins the remaining patients
+	suite.assertPatientIDs("condition-code=62106007&condition-code-status=62106007$active", "57ef3d291445d4449de25da2")
+
+	// Counting uses the same pipeline stages
+	q := search.Query{Resource: "Patient", Query: "condition-code=62106007"}
+	var result struct {
+		Count int `bson:"count"`
+	}
+	suite.Require().NoError(search.NewMongoSearcher(server.Database).CreateCountPipeline(q).One(&result))
+	suite.Equal(3, result.Count)
+}
+
+func (suite *ConditionCodeParamSuite) TestConditionCodeSearchRequiresPipeline() {
+	assert := suite.Assert()
+
+	searcher := search.NewMongoSearcher(server.Database)
+	q := search.Query{Resource: "Patient", Query: "condition-code=http://snomed.info/sct|62106007,44465007"}
+	assert.True(searcher.RequiresPipeline(q))
+	assert.False(searcher.RequiresPipeline(search.Query{Resource: "Patient", Query: "gender=male"}))
+	assert.Panics(func() { searcher.CreateQuery(q) })
+
+	// The OR values are preserved when rebuilding the query (e.g., for paging links)
+	params := q.URLQueryParameters(false)
+	suite.Require().Len(params.All(), 1)
+	assert.Equal("http://snomed.info/sct|62106007,44465007", params.Get("condition-code"))
+
+	q = search.Query{Resource: "Patient", Query: "condition-code:not=62106007"}
+	params = q.URLQueryParameters(false)
+	assert.Equal("62106007", params.Get("condition-code:not"))
+}
+
+func (suite *ConditionCodeParamSuite) TestReverseChainedConditionCodeSearch() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	suite.insertFixtures()
+
+	// The generic _has parameter should find the same patients as condition-code, using a pipeline
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: "Patient", Query: "_has:Condition:patient:code=http://snomed.info/sct|44465007,62106007"}
+	searcher := search.NewMongoSearcher(server.Database)
+	assert.True(searcher.RequiresPipeline(q))
+	require.NoError(searcher.CreatePipeline(q).All(&results))
+
+	obtained := make([]string, len(results))
+	for i := range results {
+		obtained[i] = results[i].ID
+	}
+	sort.Strings(obtained)
+	assert.Equal([]string{"57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2", "57ef3d291445d4449de25da2",
+		"57eg3d291445d4449de25da2"}, obtained)
+
+	params := q.URLQueryParameters(false)
+	assert.Equal("http://snomed.info/sct|44465007,62106007", params.Get("_has:Condition:patient:code"))
+}
+
+func (suite *ConditionCodeParamSuite) TestReverseChainedPipelineSearch() {
+	require := suite.Require()
+
+	// The patients' general practitioners are found by the patients' conditions, which are themselves searched with
+	// a pipeline (condition-code)
+	suite.insertFixtures()
+	practitioners := map[string][]string{
+		"57ec3d291445d4449de25db1": {"57ec3d291445d4449de25da2", "57eh3d291445d4449de25da2"},
+		"57ec3d291445d4449de25db2": {"57eg3d291445d4449de25da2"},
+		"57ec3d291445d4449de25db3": nil,
+	}
+	for practitionerID, patientIDs := range practitioners {
+		require.NoError(server.Database.C("practitioners").Insert(bson.M{"_id": practitionerID, "resourceType": "Practitioner"}))
+		for _, id := range patientIDs {
+			ref := models.Reference{Reference: "Practitioner/" + practitionerID, ReferencedID: practitionerID, Type: "Practitioner"}
+			require.NoError(server.Database.C("patients").UpdateId(id, bson.M{"$set": bson.M{"generalPractitioner": []models.Reference{ref}}}))
+		}
+	}
+
+	assertPractitionerIDs := func(query string, ids ...string) {
+		var results []struct {
+			ID string `bson:"_id"`
+		}
+		q := search.Query{Resource: "Practitioner", Query: query}
+		require.NoError(search.NewMongoSearcher(server.Database).CreatePipeline(q).All(&results))
+		obtained := []string{}
+		for _, result := range results {
+			obtained = append(obtained, result.ID)
+		}
+		sort.Strings(obtained)
+		if ids == nil {
+			ids = []string{}
+		}
+		suite.Equal(ids, obtained, query)
+	}
+
+	assertPractitionerIDs("_has:Patient:general-practitioner:condition-code=62106007", "57ec3d291445d4449de25db1")
+	assertPractitionerIDs("_has:Patient:general-practitioner:condition-code=44465007", "57ec3d291445d4449de25db1",
+		"57ec3d291445d4449de25db2")
+	assertPractitionerIDs("_has:Patient:general-practitioner:condition-code=http://loinc.org|44465007")
+
+	// Only the first _has is used as the source; the second joins the remaining practitioners' patients
+	assertPractitionerIDs("_has:Patient:general-practitioner:_id=57eh3d291445d4449de25da2"+
+		"&_has:Patient:general-practitioner:condition-code=62106007", "57ec3d291445d4449de25db1")
+	assertPractitionerIDs("_has:Patient:general-practitioner:_id=57eg3d291445d4449de25da2" +
+		"&_has:Patient:general-practitioner:condition-code=62106007")
+}
+
+func (suite *ConditionCodeParamSuite) TestReverseChainedSearchInvalidReference() {
+	// Condition's code parameter is not a reference, and Condition's asserter can't reference an Observation
+	for _, query := range []string{"_has:Condition:code:code=62106007", "_has:Condition:asserter:code=62106007", "_has:Condition:patient=62106007"} {
+		q := search.Query{Resource: "Observation", Query: query}
+		suite.Panics(func() { q.Params() }, query)
+	}
+}
+
+// insertFixtures inserts the conditions fixture, plus a bare patient for each condition's subject
+// and one patient with no conditions.
+func (suite *ConditionCodeParamSuite) insertFixtures() {
+	var conditions []models.Condition
+	suite.InsertFixture("conditions", "../fixtures/conditions.json", &conditions)
+
+	ids := []string{"57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2", "57ef3d291445d4449de25da2",
+		"57eg3d291445d4449de25da2", "57eh3d291445d4449de25da2", "57ei3d291445d4449de25da2"}
+	for _, id := range ids {
+		suite.Require().NoError(server.Database.C("patients").Insert(bson.M{"_id": id, "resourceType": "Patient"}))
+	}
+}
+
+func (suite *ConditionCodeParamSuite) assertPatientIDs(query string, ids ...string) {
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: "Patient", Query: query}
+	suite.Require().NoError(search.NewMongoSearcher(server.Database).CreatePipeline(q).All(&results))
+
+	obtained := make([]string, len(results))
+	for i := range results {
+		obtained[i] = results[i].ID
+	}
+	sort.Strings(obtained)
+	if ids == nil {
+		ids = []string{}
+	}
+	suite.Assert().Equal(ids, obtained, query)
+}
@@ -0,0 +1,163 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestConditionalCreateSuite(t *testing.T) {
+	suite.Run(t, new(ConditionalCreateSuite))
+}
+
+type ConditionalCreateSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *ConditionalCreateSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *ConditionalCreateSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *ConditionalCreateSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *ConditionalCreateSuite) TestCreateHandler() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	body := `{"resourceType": "Patient", "identifier": [{"system": "urn:test", "value": "1"}]}`
+	w := suite.post("/Patient", "identifier=urn:test|1", body)
+	require.Equal(http.StatusCreated, w.Code)
+	created := new(models.Patient)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), created))
+
+	// The same request returns the existing patient
+	w = suite.post("/Patient", "identifier=urn:test|1", body)
+	require.Equal(http.StatusOK, w.Code)
+	existing := new(models.Patient)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), existing))
+	assert.Equal(created.Id, existing.Id)
+	assert.Equal("http://example.com/Patient/"+created.Id, w.Header().Get("Location"))
+	suite.assertPatientCount(1)
+
+	// Multiple matches fail
+	_, err := suite.dal.Post(&models.Patient{Identifier: []models.Identifier{{System: "urn:test", Value: "1"}}})
+	require.NoError(err)
+	assert.Equal(http.StatusPreconditionFailed, suite.post("/Patient", "identifier=urn:test|1", body).Code)
+	suite.assertPatientCount(2)
+
+	// Unsupported criteria fail
+	assert.Equal(http.StatusNotImplemented, suite.post("/Patient", "foo=bar", body).Code)
+}
+
+func (suite *ConditionalCreateSuite) TestConcurrentCreates() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Half the requests list the criteria's parameters in a different order, which shouldn't matter
+	body := `{"resourceType": "Patient", "gender": "male", "identifier": [{"system": "urn:test", "value": "1"}]}`
+	criteria := []string{"identifier=urn:test|1&gender=male", "gender=male&identifier=urn:test|1"}
+	responses := make([]*httptest.ResponseRecorder, 10)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = suite.post("/Patient", criteria[i%2], body)
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	ids := make(map[string]bool)
+	for _, w := range responses {
+		require.Contains([]int{http.StatusCreated, http.StatusOK}, w.Code)
+		if w.Code == http.StatusCreated {
+			created++
+		}
+		patient := new(models.Patient)
+		require.NoError(json.Unmarshal(w.Body.Bytes(), patient))
+		ids[patient.Id] = true
+	}
+	assert.Equal(1, created)
+	assert.Len(ids, 1)
+	suite.assertPatientCount(1)
+}
+
+func (suite *ConditionalCreateSuite) TestBatch() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id, err := suite.dal.Post(&models.Patient{Identifier: []models.Identifier{{System: "urn:test", Value: "1"}}})
+	require.NoError(err)
+
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [{
+			"fullUrl": "urn:uuid:a",
+			"resource": {"resourceType": "Patient", "identifier": [{"system": "urn:test", "value": "1"}]},
+			"request": {"method": "POST", "url": "Patient", "ifNoneExist": "identifier=urn:test|1"}
+		}, {
+			"fullUrl": "urn:uuid:b",
+			"resource": {"resourceType": "Patient", "identifier": [{"system": "urn:test", "value": "2"}]},
+			"request": {"method": "POST", "url": "Patient", "ifNoneExist": "identifier=urn:test|2"}
+		}, {
+			"fullUrl": "urn:uuid:c",
+			"resource": {"resourceType": "Patient", "link": [{"other": {"reference": "urn:uuid:a"}, "type": "seealso"}]},
+			"request": {"method": "POST", "url": "Patient", "ifNoneExist": "link=urn:uuid:a"}
+		}]
+	}`
+	w := suite.post("/", "", bundle)
+	require.Equal(http.StatusOK, w.Code)
+	response := new(models.Bundle)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	require.Len(response.Entry, 3)
+	assert.Equal("200", response.Entry[0].Response.Status)
+	assert.Equal("http://example.com/Patient/"+id, response.Entry[0].Response.Location)
+	assert.Equal("201", response.Entry[1].Response.Status)
+	assert.Equal("201", response.Entry[2].Response.Status)
+	suite.assertPatientCount(3)
+
+	// Running it again creates nothing new
+	w = suite.post("/", "", bundle)
+	require.Equal(http.StatusOK, w.Code)
+	response = new(models.Bundle)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	for _, entry := range response.Entry {
+		assert.Equal("200", entry.Response.Status)
+	}
+	suite.assertPatientCount(3)
+}
+
+func (suite *ConditionalCreateSuite) post(path, ifNoneExist, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	if ifNoneExist != "" {
+		r.Header.Set("If-None-Exist", ifNoneExist)
+	}
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
+
+func (suite *ConditionalCreateSuite) assertPatientCount(expected int) {
+	n, err := server.Database.C("patients").Count()
+	suite.Require().NoError(err)
+	suite.Assert().Equal(expected, n)
+}
@@ -0,0 +1,143 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestConditionalReferencesSuite(t *testing.T) {
+	suite.Run(t, new(ConditionalReferencesSuite))
+}
+
+type ConditionalReferencesSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *ConditionalReferencesSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *ConditionalReferencesSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *ConditionalReferencesSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *ConditionalReferencesSuite) TestCreateHandler() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	body := `{"resourceType": "Condition", "subject": {"reference": "Patient?identifier=urn:test|1"}}`
+	assert.Equal(http.StatusPreconditionFailed, suite.post("/Condition", body).Code)
+
+	id := suite.createPatient("1")
+	w := suite.post("/Condition", body)
+	require.Equal(http.StatusCreated, w.Code)
+	condition := new(models.Condition)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), condition))
+	assert.Equal("Patient/"+id, condition.Subject.Reference)
+
+	// The stored reference can be searched on
+	IDs, err := suite.dal.FindIDs(search.Query{Resource: "Condition", Query: "patient=" + id})
+	require.NoError(err)
+	assert.Len(IDs, 1)
+
+	suite.createPatient("1")
+	w = suite.post("/Condition", body)
+	require.Equal(http.StatusPreconditionFailed, w.Code)
+	outcome := new(models.OperationOutcome)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), outcome))
+	assert.Equal("multiple-matches", outcome.Issue[0].Code)
+}
+
+func (suite *ConditionalReferencesSuite) TestBundleDependencies() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id := suite.createPatient("1")
+
+	// The conditional PUT depends on the conditional POST, which depends on the POST
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"fullUrl": "urn:uuid:condition",
+			"resource": {"resourceType": "Condition", "code": {"text": "b"}, "subject": {"reference": "Patient?identifier=urn:test|1"}, "asserter": {"reference": "urn:uuid:patient"}},
+			"request": {"method": "PUT", "url": "Condition?asserter=urn:uuid:patient2"}
+		}, {
+			"fullUrl": "urn:uuid:patient2",
+			"resource": {"resourceType": "Patient", "link": [{"other": {"reference": "urn:uuid:patient"}, "type": "seealso"}]},
+			"request": {"method": "POST", "url": "Patient", "ifNoneExist": "link=urn:uuid:patient"}
+		}, {
+			"fullUrl": "urn:uuid:patient",
+			"resource": {"resourceType": "Patient", "gender": "male"},
+			"request": {"method": "POST", "url": "Patient"}
+		}]
+	}`
+	w := suite.post("/", bundle)
+	require.Equal(http.StatusOK, w.Code, w.Body.String())
+	response := new(models.Bundle)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	for i := range response.Entry {
+		assert.Equal("201", response.Entry[i].Response.Status, i)
+	}
+
+	var conditions []models.Condition
+	require.NoError(server.Database.C("conditions").Find(nil).All(&conditions))
+	require.Len(conditions, 1)
+	assert.Equal("Patient/"+id, conditions[0].Subject.Reference)
+
+	// A circular dependency fails
+	bundle = `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"fullUrl": "urn:uuid:a",
+			"resource": {"resourceType": "Patient"},
+			"request": {"method": "POST", "url": "Patient", "ifNoneExist": "link=urn:uuid:b"}
+		}, {
+			"fullUrl": "urn:uuid:b",
+			"resource": {"resourceType": "Patient"},
+			"request": {"method": "POST", "url": "Patient", "ifNoneExist": "link=urn:uuid:a"}
+		}]
+	}`
+	assert.Equal(http.StatusBadRequest, suite.post("/", bundle).Code)
+
+	// As does a conditional reference without a match
+	bundle = `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"resource": {"resourceType": "Condition", "subject": {"reference": "Patient?identifier=urn:test|2"}},
+			"request": {"method": "POST", "url": "Condition"}
+		}]
+	}`
+	assert.Equal(http.StatusPreconditionFailed, suite.post("/", bundle).Code)
+}
+
+func (suite *ConditionalReferencesSuite) createPatient(identifier string) string {
+	id, err := suite.dal.Post(&models.Patient{Identifier: []models.Identifier{{System: "urn:test", Value: identifier}}})
+	suite.Require().NoError(err)
+	return id
+}
+
+func (suite *ConditionalReferencesSuite) post(path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,78 @@
+package synthma
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestConformanceSuite(t *testing.T) {
+	suite.Run(t, new(ConformanceSuite))
+}
+
+type ConformanceSuite struct {
+	suite.Suite
+}
+
+func (suite *ConformanceSuite) TestWithoutHistory() {
+	statement := suite.statement(false)
+	suite.Equal([]string{"batch", "transaction"}, suite.codes(statement.Rest[0].Interaction))
+	patient := suite.resource(statement, "Patient")
+	suite.Equal([]string{"create", "read", "update", "delete"}, suite.resourceCodes(patient.Interaction))
+	// Version IDs and If-Match are supported without history
+	suite.Equal("versioned-update", patient.Versioning)
+}
+
+func (suite *ConformanceSuite) TestWithHistory() {
+	statement := suite.statement(true)
+	suite.Equal([]string{"history-system", "batch", "transaction"}, suite.codes(statement.Rest[0].Interaction))
+	patient := suite.resource(statement, "Patient")
+	suite.Equal([]string{"create", "read", "update", "delete", "vread", "history-instance", "history-type"},
+		suite.resourceCodes(patient.Interaction))
+}
+
+func (suite *ConformanceSuite) statement(enableHistory bool) *models.Conformance {
+	handler, err := server.NewConformanceHandler(server.ConformanceStatementPath, server.Config{EnableHistory: enableHistory})
+	suite.Require().NoError(err)
+	e := gin.New()
+	e.GET("/metadata", handler)
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metadata", nil))
+	suite.Require().Equal(200, w.Code)
+	statement := new(models.Conformance)
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), statement))
+	suite.Require().Len(statement.Rest, 1)
+	return statement
+}
+
+func (suite *ConformanceSuite) resource(statement *models.Conformance, name string) models.ConformanceRestResourceComponent {
+	for _, resource := range statement.Rest[0].Resource {
+		if resource.Type == name {
+			return resource
+		}
+	}
+	suite.FailNow("Resource not found", name)
+	return models.ConformanceRestResourceComponent{}
+}
+
+func (suite *ConformanceSuite) codes(interactions []models.ConformanceSystemInteractionComponent) []string {
+	var codes []string
+	for _, i := range interactions {
+		codes = append(codes, i.Code)
+	}
+	return codes
+}
+
+func (suite *ConformanceSuite) resourceCodes(interactions []models.ConformanceResourceInteractionComponent) []string {
+	var codes []string
+	for _, i := range interactions {
+		codes = append(codes, i.Code)
+	}
+	return codes
+}
@@ -0,0 +1,116 @@
+package synthma
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestDateBoundsSuite(t *testing.T) {
+	suite.Run(t, new(DateBoundsSuite))
+}
+
+type DateBoundsSuite struct {
+	testutil.MongoSuite
+	names map[string]string
+}
+
+func (suite *DateBoundsSuite) SetupTest() {
+	dal, _ := newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+
+	conditions := map[string]*models.Condition{
+		"mid-2010":  {OnsetDateTime: date(2010, 5, 5)},
+		"end-2010":  {OnsetDateTime: date(2010, 12, 31)},
+		"new-2011":  {OnsetDateTime: date(2011, 1, 1)},
+		"2009-2010": {OnsetPeriod: &models.Period{Start: date(2009, 6, 1), End: date(2010, 6, 30)}},
+		"ongoing":   {OnsetPeriod: &models.Period{Start: date(2010, 11, 1)}},
+		"2020":      {OnsetDateTime: date(2020, 1, 1)},
+	}
+	suite.names = make(map[string]string)
+	for name, condition := range conditions {
+		id, err := dal.Post(condition)
+		suite.Require().NoError(err)
+		suite.names[id] = name
+	}
+}
+
+func (suite *DateBoundsSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *DateBoundsSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *DateBoundsSuite) TestPrefixes() {
+	// A date covers its whole day, so it's within the year
+	suite.assertOnsets("onset-date=2010", "end-2010", "mid-2010")
+	suite.assertOnsets("onset-date=2010-12-31", "end-2010")
+	suite.assertOnsets("onset-date=ne2010", "2009-2010", "2020", "new-2011", "ongoing")
+	suite.assertOnsets("onset-date=lt2010-06", "2009-2010", "mid-2010")
+	suite.assertOnsets("onset-date=sa2010", "2020", "new-2011")
+	suite.assertOnsets("onset-date=eb2010-07", "2009-2010", "mid-2010")
+	// An ongoing period extends after any date
+	suite.assertOnsets("onset-date=gt2015", "2020", "ongoing")
+	// Approximate dates are widened by 10% of the time until now
+	suite.assertOnsets("onset-date=ap2010-12-31", "2009-2010", "end-2010", "mid-2010", "new-2011", "ongoing")
+}
+
+func (suite *DateBoundsSuite) TestCohortWindow() {
+	// Dates at the end of the year are in that year's window, and not the next year's
+	suite.assertOnsets("onset-date=ge2010&onset-date=lt2011", "end-2010", "mid-2010", "ongoing")
+	suite.assertOnsets("onset-date=ge2011&onset-date=lt2012", "new-2011", "ongoing")
+}
+
+func (suite *DateBoundsSuite) TestBackfill() {
+	require := suite.Require()
+
+	// Conditions saved by earlier versions of the server are given date bounds on startup
+	legacy := []interface{}{
+		&models.Condition{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+			OnsetDateTime:  date(2010, 8, 1),
+		},
+		&models.Condition{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "2"}},
+			OnsetPeriod:    &models.Period{Start: date(2008, 1, 1), End: date(2010, 1, 31)},
+		},
+	}
+	require.NoError(server.Database.C("conditions").Insert(legacy...))
+	suite.names["1"], suite.names["2"] = "legacy-2010", "legacy-2008-2010"
+	suite.assertOnsets("onset-date=2010", "end-2010", "mid-2010")
+
+	count, err := server.BackfillNormalizedValues(server.Database)
+	require.NoError(err)
+	suite.Assert().Equal(2, count)
+	suite.assertOnsets("onset-date=2010", "end-2010", "legacy-2010", "mid-2010")
+	suite.assertOnsets("onset-date=lt2009", "legacy-2008-2010")
+}
+
+func (suite *DateBoundsSuite) assertOnsets(query string, expected ...string) {
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: "Condition", Query: query}
+	err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).All(&results)
+	suite.Require().NoError(err)
+	names := make([]string, 0, len(results))
+	for _, result := range results {
+		names = append(names, suite.names[result.ID])
+	}
+	sort.Strings(names)
+	if expected == nil {
+		expected = []string{}
+	}
+	suite.Assert().Equal(expected, names, query)
+}
+
+func date(year int, month time.Month, day int) *models.FHIRDateTime {
+	return &models.FHIRDateTime{Time: time.Date(year, month, day, 0, 0, 0, 0, time.Local), Precision: models.Date}
+}
@@ -0,0 +1,185 @@
+package synthma
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestExportSuite(t *testing.T) {
+	suite.Run(t, new(ExportSuite))
+}
+
+type ExportSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+	dir     string
+}
+
+func (suite *ExportSuite) SetupTest() {
+
+	var err error
+	suite.dir, err = ioutil.TempDir("", "export")
+	suite.Require().NoError(err)
+	config := server.DefaultConfig
+	config.ExportPath = suite.dir
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, config)
+}
+
+func (suite *ExportSuite) TearDownTest() {
+	suite.TearDownDB()
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *ExportSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+type exportManifest struct {
+	Request string
+	Output  []struct {
+		Type  string
+		URL   string
+		Count int
+	}
+}
+
+func (suite *ExportSuite) TestExport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	male := suite.post(&models.Patient{Gender: "male"})
+	female := suite.post(&models.Patient{Gender: "female"})
+	suite.post(&models.Condition{Subject: &models.Reference{Reference: "Patient/" + male, Type: "Patient", ReferencedID: male}})
+	suite.post(&models.Condition{Subject: &models.Reference{Reference: "Patient/" + female, Type: "Patient", ReferencedID: female}})
+	suite.post(&models.Organization{Name: "Hospital"})
+	group := suite.post(&models.Group{Member: []models.GroupMemberComponent{
+		{Entity: &models.Reference{Reference: "Patient/" + female, Type: "Patient", ReferencedID: female}},
+	}})
+
+	// System-level exports include everything
+	manifest := suite.export("/$export")
+	assert.Equal(map[string]int{"Patient": 2, "Condition": 2, "Organization": 1, "Group": 1}, outputCounts(manifest))
+	assert.Equal("http://example.com/$export", manifest.Request)
+
+	// Patient-level exports only include the patients and the resources referring to them
+	manifest = suite.export("/Patient/$export")
+	assert.Equal(map[string]int{"Patient": 2, "Condition": 2, "Group": 1}, outputCounts(manifest))
+
+	manifest = suite.export("/Group/" + group + "/$export?_type=Patient,Condition")
+	assert.Equal(map[string]int{"Patient": 1, "Condition": 1}, outputCounts(manifest))
+	for _, output := range manifest.Output {
+		w := suite.do("GET", output.URL)
+		require.Equal(http.StatusOK, w.Code)
+		assert.Equal("application/fhir+ndjson", w.Header().Get("Content-Type"))
+
+		// Each file has one resource per line
+		scanner := bufio.NewScanner(w.Body)
+		require.True(scanner.Scan())
+		resource := models.NewStructForResourceName(output.Type)
+		require.NoError(json.Unmarshal(scanner.Bytes(), resource))
+		switch r := resource.(type) {
+		case *models.Patient:
+			assert.Equal(female, r.Id)
+		case *models.Condition:
+			assert.Equal("Patient/"+female, r.Subject.Reference)
+		}
+		assert.False(scanner.Scan())
+	}
+
+	// Only resources updated since _since are exported
+	manifest = suite.export("/$export?_since=" + time.Now().Add(time.Hour).Format(time.RFC3339))
+	assert.Empty(manifest.Output)
+}
+
+func (suite *ExportSuite) TestKickOffErrors() {
+	assert := suite.Assert()
+
+	assert.Equal(http.StatusBadRequest, suite.do("GET", "/$export").Code)
+	assert.Equal(http.StatusBadRequest, suite.kickOff("/$export?_type=Foo").Code)
+	assert.Equal(http.StatusBadRequest, suite.kickOff("/$export?_outputFormat=text/csv").Code)
+	assert.Equal(http.StatusNotFound, suite.kickOff("/Group/57ec3d291445d4449de25da2/$export").Code)
+	assert.Equal(http.StatusNotFound, suite.do("GET", "/$export/57ec3d291445d4449de25da2").Code)
+}
+
+func (suite *ExportSuite) TestCancel() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	suite.post(&models.Patient{Gender: "male"})
+	w := suite.kickOff("/$export")
+	require.Equal(http.StatusAccepted, w.Code)
+	status := w.Header().Get("Content-Location")
+	suite.waitForExport(status)
+
+	assert.Equal(http.StatusAccepted, suite.do("DELETE", status).Code)
+	assert.Equal(http.StatusNotFound, suite.do("GET", status).Code)
+	files, err := ioutil.ReadDir(suite.dir)
+	require.NoError(err)
+	assert.Empty(files)
+}
+
+func (suite *ExportSuite) post(resource interface{}) string {
+	id, err := suite.dal.Post(resource)
+	suite.Require().NoError(err)
+	return id
+}
+
+func (suite *ExportSuite) do(method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "http://example.com"+strings.TrimPrefix(path, "http://example.com"), nil)
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
+
+func (suite *ExportSuite) kickOff(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	r.Header.Set("Prefer", "respond-async")
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
+
+// export kicks off the export and returns its manifest once it is complete.
+func (suite *ExportSuite) export(path string) *exportManifest {
+	w := suite.kickOff(path)
+	suite.Require().Equal(http.StatusAccepted, w.Code, w.Body.String())
+	w = suite.waitForExport(w.Header().Get("Content-Location"))
+
+	manifest := new(exportManifest)
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), manifest))
+	return manifest
+}
+
+func (suite *ExportSuite) waitForExport(status string) *httptest.ResponseRecorder {
+	for i := 0; i < 100; i++ {
+		w := suite.do("GET", status)
+		if w.Code != http.StatusAccepted {
+			suite.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+			return w
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	suite.FailNow("Export did not complete")
+	return nil
+}
+
+func outputCounts(manifest *exportManifest) map[string]int {
+	counts := make(map[string]int)
+	for _, output := range manifest.Output {
+		counts[output.Type] = output.Count
+	}
+	return counts
+}
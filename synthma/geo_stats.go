@@ -0,0 +1,147 @@
+package synthma
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+)
+
+// Constant values for the levels at which statistics are rolled up geographically.
+const (
+	StateLevel      = "state"
+	CountyLevel     = "county"
+	CityLevel       = "city"
+	PostalCodeLevel = "postal_code"
+)
+
+// RegionLevels lists the supported geographic levels, from largest to smallest.
+var RegionLevels = []string{StateLevel, CountyLevel, CityLevel, PostalCodeLevel}
+
+func isRegionLevel(level string) bool {
+	for _, l := range RegionLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Region identifies a geographic area.  Regions are always scoped by state, so Name is the name of
+// the state, county, city, or postal code depending on the Level.
+type Region struct {
+	Level string
+	State string
+	Name  string
+}
+
+// Regions returns the regions the patient lives in, at each level for which the patient's address
+// has data.  Patients without a state are not placed in any region.
+func (f PatientFact) Regions() []Region {
+	if f.State == "" {
+		return nil
+	}
+	regions := []Region{{Level: StateLevel, State: f.State, Name: f.State}}
+	if f.County != "" {
+		regions = append(regions, Region{Level: CountyLevel, State: f.State, Name: f.County})
+	}
+	if f.City != "" {
+		regions = append(regions, Region{Level: CityLevel, State: f.State, Name: f.City})
+	}
+	if f.PostalCode != "" {
+		regions = append(regions, Region{Level: PostalCodeLevel, State: f.State, Name: f.PostalCode})
+	}
+	return regions
+}
+
+// RegionQuery describes the regional statistics to retrieve.  Level is required.  State and Region
+// optionally narrow the results to a single state or a single named region.  Prevalence is only
+// reported for the conditions listed in Codes (a Coding without a System matches any system).
+type RegionQuery struct {
+	Level  string
+	State  string
+	Region string
+	Codes  []models.Coding
+}
+
+// RegionStatistics contains the statistics for a single region.  The Gender and AgeBand breakdowns
+// count living patients only.
+type RegionStatistics struct {
+	Level      string                `json:"level"`
+	State      string                `json:"state"`
+	Region     string                `json:"region"`
+	Living     int                   `json:"living"`
+	Deceased   int                   `json:"deceased"`
+	Gender     map[string]int        `json:"gender"`
+	AgeBand    map[string]int        `json:"ageBand"`
+	Conditions []ConditionPrevalence `json:"conditions,omitempty"`
+}
+
+// ConditionPrevalence is the number of distinct patients having a given condition code.
+type ConditionPrevalence struct {
+	System   string `json:"system"`
+	Code     string `json:"code"`
+	Patients int    `json:"patients"`
+}
+
+// RegionStatisticsReader is implemented by statistics stores that keep geographic rollups.
+type RegionStatisticsReader interface {
+	RegionStatistics(query RegionQuery) ([]RegionStatistics, error)
+}
+
+// RegisterStatisticsRoutes registers the GET /$stats endpoint, to be set up after the server's
+// standard routes.
+func RegisterStatisticsRoutes(s *server.FHIRServer, reader RegionStatisticsReader) {
+	s.AfterRoutes = append(s.AfterRoutes, func(e *gin.Engine) {
+		e.GET("/$stats", RegionStatisticsHandler(reader))
+	})
+}
+
+// RegionStatisticsHandler returns a handler that responds with the statistics for each region
+// matching the request's query parameters:
+//
+//	level:  one of the RegionLevels (default: state)
+//	state:  only return regions in this state
+//	region: only return the region with this name
+//	code:   comma-separated condition tokens ([system|]code) to report prevalence for
+func RegionStatisticsHandler(reader RegionStatisticsReader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := RegionQuery{
+			Level:  c.DefaultQuery("level", StateLevel),
+			State:  c.Query("state"),
+			Region: c.Query("region"),
+		}
+
+		if !isRegionLevel(query.Level) {
+			oo := models.NewOperationOutcome("error", "invalid", "Parameter \"level\" must be one of: "+strings.Join(RegionLevels, ", "))
+			c.JSON(http.StatusBadRequest, oo)
+			return
+		}
+
+		for _, codes := range c.Request.URL.Query()["code"] {
+			for _, token := range strings.Split(codes, ",") {
+				if token == "" {
+					continue
+				}
+				coding := models.Coding{Code: token}
+				if i := strings.LastIndex(token, "|"); i >= 0 {
+					coding.System, coding.Code = token[:i], token[i+1:]
+				}
+				query.Codes = append(query.Codes, coding)
+			}
+		}
+
+		stats, err := reader.RegionStatistics(query)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if stats == nil {
+			stats = []RegionStatistics{}
+		}
+
+		c.JSON(http.StatusOK, stats)
+	}
+}
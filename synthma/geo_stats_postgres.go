@@ -0,0 +1,197 @@
+package synthma
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// RegionStatistics implements RegionStatisticsReader.
+func (p *PostgresStatisticsStore) RegionStatistics(query RegionQuery) ([]RegionStatistics, error) {
+	where, args := regionWhereClause(query)
+
+	rows, err := p.DB.Query(`SELECT state, region, gender, age_band, living, deceased FROM geo_population`+where+
+		` ORDER BY state, region`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []RegionStatistics
+	index := make(map[[2]string]int)
+	for rows.Next() {
+		var state, region, gender, ageBand string
+		var living, deceased int
+		if err = rows.Scan(&state, &region, &gender, &ageBand, &living, &deceased); err != nil {
+			return nil, err
+		}
+		key := [2]string{state, region}
+		i, ok := index[key]
+		if !ok {
+			i = len(results)
+			index[key] = i
+			results = append(results, RegionStatistics{
+				Level:   query.Level,
+				State:   state,
+				Region:  region,
+				Gender:  make(map[string]int),
+				AgeBand: make(map[string]int),
+			})
+		}
+		results[i].Living += living
+		results[i].Deceased += deceased
+		results[i].Gender[gender] += living
+		results[i].AgeBand[ageBand] += living
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(query.Codes) == 0 || len(results) == 0 {
+		return results, nil
+	}
+
+	// Add the prevalence of the requested conditions
+	var codeClause bytes.Buffer
+	for i, coding := range query.Codes {
+		if i > 0 {
+			codeClause.WriteString(" OR ")
+		}
+		args = append(args, coding.Code)
+		codeClause.WriteString(fmt.Sprintf("(code = $%d", len(args)))
+		if coding.System != "" {
+			args = append(args, coding.System)
+			codeClause.WriteString(fmt.Sprintf(" AND system = $%d", len(args)))
+		}
+		codeClause.WriteString(")")
+	}
+
+	rows, err = p.DB.Query(`SELECT state, region, system, code, patients FROM geo_condition_prevalence`+where+
+		` AND (`+codeClause.String()+`) ORDER BY state, region, system, code`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state, region string
+		var prevalence ConditionPrevalence
+		if err = rows.Scan(&state, &region, &prevalence.System, &prevalence.Code, &prevalence.Patients); err != nil {
+			return nil, err
+		}
+		if i, ok := index[[2]string{state, region}]; ok {
+			results[i].Conditions = append(results[i].Conditions, prevalence)
+		}
+	}
+	return results, rows.Err()
+}
+
+func regionWhereClause(query RegionQuery) (string, []interface{}) {
+	where := " WHERE level = $1"
+	args := []interface{}{query.Level}
+	if query.State != "" {
+		args = append(args, query.State)
+		where += fmt.Sprintf(" AND state = $%d", len(args))
+	}
+	if query.Region != "" {
+		args = append(args, query.Region)
+		where += fmt.Sprintf(" AND region = $%d", len(args))
+	}
+	return where, args
+}
+
+// selectPatientConditionKeys returns the (system, code) keys of all the stored conditions for a patient.
+func selectPatientConditionKeys(tx *sql.Tx, patientID string) ([][2]string, error) {
+	rows, err := tx.Query(`SELECT system, code FROM patient_condition_codes WHERE patient_id = $1`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][2]string
+	for rows.Next() {
+		var key [2]string
+		if err = rows.Scan(&key[0], &key[1]); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// adjustGeoPopulation adds delta to the count of living or deceased patients in the fact's gender and
+// age band in each of the patient's regions, removing the rows no patients are counted in.
+func adjustGeoPopulation(tx *sql.Tx, fact PatientFact, delta int) error {
+	living, deceased := livingAndDeceased(fact, delta)
+	for _, region := range uniqueRegions(fact.Regions()) {
+		_, err := tx.Exec(`INSERT INTO geo_population (level, state, region, gender, age_band, living, deceased)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (level, state, region, gender, age_band) DO UPDATE SET living = geo_population.living + EXCLUDED.living,
+				deceased = geo_population.deceased + EXCLUDED.deceased`,
+			region.Level, region.State, region.Name, fact.Gender, fact.AgeBand, living, deceased)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM geo_population WHERE level = $1 AND state = $2 AND region = $3 AND gender = $4
+			AND age_band = $5 AND living <= 0 AND deceased <= 0`,
+			region.Level, region.State, region.Name, fact.Gender, fact.AgeBand)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustGeoConditionPrevalence adds delta to the number of patients having each of the (system, code)
+// keys in each of the given regions, removing the rows no patients are counted in.  The keys are
+// updated in order, so concurrent changes can't deadlock.
+func adjustGeoConditionPrevalence(tx *sql.Tx, regions []Region, keys [][2]string, delta int) error {
+	keys = uniqueKeys(keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	for _, region := range uniqueRegions(regions) {
+		for _, key := range keys {
+			_, err := tx.Exec(`INSERT INTO geo_condition_prevalence (level, state, region, system, code, patients)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (level, state, region, system, code) DO UPDATE
+				SET patients = geo_condition_prevalence.patients + EXCLUDED.patients`,
+				region.Level, region.State, region.Name, key[0], key[1], delta)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`DELETE FROM geo_condition_prevalence
+				WHERE level = $1 AND state = $2 AND region = $3 AND system = $4 AND code = $5 AND patients <= 0`,
+				region.Level, region.State, region.Name, key[0], key[1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func uniqueRegions(regions []Region) []Region {
+	seen := make(map[Region]bool)
+	var unique []Region
+	for _, region := range regions {
+		if !seen[region] {
+			seen[region] = true
+			unique = append(unique, region)
+		}
+	}
+	return unique
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, value := range values {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,140 @@
+package synthma
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestGeoStatisticsSuite(t *testing.T) {
+	suite.Run(t, new(GeoStatisticsSuite))
+}
+
+type GeoStatisticsSuite struct {
+	suite.Suite
+	reader *fakeRegionStatisticsReader
+	engine *gin.Engine
+}
+
+func (suite *GeoStatisticsSuite) SetupTest() {
+	gin.SetMode(gin.ReleaseMode)
+	suite.reader = &fakeRegionStatisticsReader{}
+	suite.engine = gin.New()
+	suite.engine.GET("/$stats", RegionStatisticsHandler(suite.reader))
+}
+
+func (suite *GeoStatisticsSuite) TestPatientFactRegions() {
+	assert := suite.Assert()
+
+	patient := &models.Patient{
+		Address: []models.Address{
+			{Use: "work", City: "Boston", State: "MA"},
+			{Use: "home", City: "Bedford", District: "Middlesex", State: "MA", PostalCode: "01730"},
+		},
+	}
+
+	fact := NewPatientFact(patient, time.Now())
+	assert.Equal([]Region{
+		{Level: StateLevel, State: "MA", Name: "MA"},
+		{Level: CountyLevel, State: "MA", Name: "Middlesex"},
+		{Level: CityLevel, State: "MA", Name: "Bedford"},
+		{Level: PostalCodeLevel, State: "MA", Name: "01730"},
+	}, fact.Regions())
+
+	// Missing parts of the address are skipped
+	patient.Address = []models.Address{{City: "Boston", State: "MA"}}
+	assert.Equal([]Region{
+		{Level: StateLevel, State: "MA", Name: "MA"},
+		{Level: CityLevel, State: "MA", Name: "Boston"},
+	}, NewPatientFact(patient, time.Now()).Regions())
+
+	// No state, no regions
+	patient.Address = []models.Address{{City: "Boston"}}
+	assert.Empty(NewPatientFact(patient, time.Now()).Regions())
+}
+
+func (suite *GeoStatisticsSuite) TestRegionStatisticsHandler() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	suite.reader.stats = []RegionStatistics{
+		{
+			Level:    CountyLevel,
+			State:    "MA",
+			Region:   "Middlesex",
+			Living:   2,
+			Deceased: 1,
+			Gender:   map[string]int{"male": 1, "female": 1},
+			AgeBand:  map[string]int{"30-39": 2},
+			Conditions: []ConditionPrevalence{
+				{System: "http://snomed.info/sct", Code: "62106007", Patients: 1},
+			},
+		},
+	}
+
+	w := suite.get("/$stats?level=county&state=MA&code=http://snomed.info/sct|62106007,44054006")
+	require.Equal(http.StatusOK, w.Code)
+
+	assert.Equal(RegionQuery{
+		Level: CountyLevel,
+		State: "MA",
+		Codes: []models.Coding{
+			{System: "http://snomed.info/sct", Code: "62106007"},
+			{Code: "44054006"},
+		},
+	}, suite.reader.query)
+
+	var stats []RegionStatistics
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(suite.reader.stats, stats)
+}
+
+func (suite *GeoStatisticsSuite) TestRegionStatisticsHandlerDefaultsToStateLevel() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	w := suite.get("/$stats")
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal(RegionQuery{Level: StateLevel}, suite.reader.query)
+	assert.JSONEq("[]", w.Body.String())
+}
+
+func (suite *GeoStatisticsSuite) TestRegionStatisticsHandlerInvalidLevel() {
+	w := suite.get("/$stats?level=planet")
+	suite.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (suite *GeoStatisticsSuite) TestRegisterStatisticsRoutes() {
+	s := server.NewServer("localhost")
+	RegisterStatisticsRoutes(s, suite.reader)
+	suite.Require().Len(s.AfterRoutes, 1)
+
+	e := gin.New()
+	s.AfterRoutes[0](e)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/$stats", nil))
+	suite.Equal(http.StatusOK, w.Code)
+}
+
+func (suite *GeoStatisticsSuite) get(url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	suite.engine.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	return w
+}
+
+type fakeRegionStatisticsReader struct {
+	query RegionQuery
+	stats []RegionStatistics
+}
+
+func (f *fakeRegionStatisticsReader) RegionStatistics(query RegionQuery) ([]RegionStatistics, error) {
+	f.query = query
+	return f.stats, nil
+}
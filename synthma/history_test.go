@@ -0,0 +1,321 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestHistorySuite(t *testing.T) {
+	suite.Run(t, new(HistorySuite))
+}
+
+type HistorySuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *HistorySuite) SetupTest() {
+	suite.dal, suite.handler = suite.newServer(true)
+}
+
+func (suite *HistorySuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *HistorySuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *HistorySuite) TestVersionIDsWithoutHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+	dal, _ := suite.newServer(false)
+
+	patient := &models.Patient{Gender: "male"}
+	id, err := dal.Post(patient)
+	require.NoError(err)
+	assert.Equal("1", patient.Meta.VersionId)
+
+	patient = &models.Patient{Gender: "female"}
+	createdNew, err := dal.Put(id, patient)
+	require.NoError(err)
+	assert.False(createdNew)
+	assert.Equal("2", patient.Meta.VersionId)
+
+	// Prior versions are not kept
+	n, err := server.Database.C("patients_prev").Count()
+	require.NoError(err)
+	assert.Equal(0, n)
+
+	_, err = dal.GetVersion(id, "1", "Patient")
+	assert.Equal(server.ErrNotFound, err)
+	result, err := dal.GetVersion(id, "2", "Patient")
+	require.NoError(err)
+	assert.Equal("female", result.(*models.Patient).Gender)
+
+	require.NoError(dal.Delete(id, "Patient"))
+	_, err = dal.Get(id, "Patient")
+	assert.Equal(server.ErrNotFound, err)
+}
+
+func (suite *HistorySuite) TestVersionRead() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id := suite.createPatientVersions()
+
+	for version, gender := range map[string]string{"1": "male", "2": "female", "3": "other"} {
+		result, err := suite.dal.GetVersion(id, version, "Patient")
+		require.NoError(err, version)
+		assert.Equal(id, result.(*models.Patient).Id)
+		assert.Equal(version, result.(*models.Patient).Meta.VersionId)
+		assert.Equal(gender, result.(*models.Patient).Gender)
+	}
+
+	require.NoError(suite.dal.Delete(id, "Patient"))
+	_, err := suite.dal.Get(id, "Patient")
+	assert.Equal(server.ErrDeleted, err)
+	_, err = suite.dal.GetVersion(id, "4", "Patient")
+	assert.Equal(server.ErrDeleted, err)
+	_, err = suite.dal.GetVersion(id, "5", "Patient")
+	assert.Equal(server.ErrNotFound, err)
+
+	// Prior versions remain available
+	result, err := suite.dal.GetVersion(id, "3", "Patient")
+	require.NoError(err)
+	assert.Equal("other", result.(*models.Patient).Gender)
+
+	// Recreating the resource continues its history
+	patient := &models.Patient{Gender: "unknown"}
+	createdNew, err := suite.dal.Put(id, patient)
+	require.NoError(err)
+	assert.True(createdNew)
+	assert.Equal("5", patient.Meta.VersionId)
+	_, err = suite.dal.Get(id, "Patient")
+	assert.NoError(err)
+}
+
+func (suite *HistorySuite) TestInstanceHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id := suite.createPatientVersions()
+	require.NoError(suite.dal.Delete(id, "Patient"))
+	suite.createPatientVersions()
+
+	bundle, err := suite.dal.History(url.URL{}, "Patient", id, server.HistoryOptions{})
+	require.NoError(err)
+	assert.Equal("history", bundle.Type)
+	assert.Equal(uint32(4), *bundle.Total)
+	require.Len(bundle.Entry, 4)
+
+	assert.Equal("DELETE", bundle.Entry[0].Request.Method)
+	assert.Equal("Patient/"+id, bundle.Entry[0].Request.Url)
+	assert.Nil(bundle.Entry[0].Resource)
+	assert.Equal(`W/"4"`, bundle.Entry[0].Response.Etag)
+	for i, gender := range []string{"other", "female", "male"} {
+		entry := bundle.Entry[i+1]
+		assert.Equal(gender, entry.Resource.(*models.Patient).Gender)
+		assert.Equal(id, entry.Resource.(*models.Patient).Id)
+	}
+	assert.Equal("PUT", bundle.Entry[1].Request.Method)
+	assert.Equal("POST", bundle.Entry[3].Request.Method)
+	assert.Equal("Patient", bundle.Entry[3].Request.Url)
+
+	// Paging
+	bundle, err = suite.dal.History(url.URL{}, "Patient", id, server.HistoryOptions{Count: 2, Offset: 1})
+	require.NoError(err)
+	assert.Equal(uint32(4), *bundle.Total)
+	require.Len(bundle.Entry, 2)
+	assert.Equal("other", bundle.Entry[0].Resource.(*models.Patient).Gender)
+	assert.Equal("female", bundle.Entry[1].Resource.(*models.Patient).Gender)
+	assert.Contains(suite.links(bundle), "next")
+}
+
+func (suite *HistorySuite) TestTypeAndSystemHistory() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	suite.createPatientVersions()
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	suite.createPatientVersions()
+	time.Sleep(10 * time.Millisecond)
+	_, err := suite.dal.Post(&models.Condition{ClinicalStatus: "active"})
+	require.NoError(err)
+
+	bundle, err := suite.dal.History(url.URL{}, "Patient", "", server.HistoryOptions{})
+	require.NoError(err)
+	assert.Equal(uint32(6), *bundle.Total)
+
+	bundle, err = suite.dal.History(url.URL{}, "Patient", "", server.HistoryOptions{Since: since})
+	require.NoError(err)
+	assert.Equal(uint32(3), *bundle.Total)
+
+	bundle, err = suite.dal.History(url.URL{}, "", "", server.HistoryOptions{})
+	require.NoError(err)
+	assert.Equal(uint32(7), *bundle.Total)
+	require.Len(bundle.Entry, 7)
+	assert.IsType(&models.Condition{}, bundle.Entry[0].Resource)
+}
+
+func (suite *HistorySuite) TestConditionalDelete() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	id := suite.createPatientVersions()
+	count, err := suite.dal.ConditionalDelete(search.Query{Resource: "Patient", Query: "gender=other"})
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	_, err = suite.dal.Get(id, "Patient")
+	assert.Equal(server.ErrDeleted, err)
+}
+
+func (suite *HistorySuite) TestHistoryHandlers() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	h := suite.handler
+
+	id := suite.createPatientVersions()
+	require.NoError(suite.dal.Delete(id, "Patient"))
+
+	assert.Equal(http.StatusGone, suite.get(h, "/Patient/"+id).Code)
+	assert.Equal(http.StatusGone, suite.get(h, "/Patient/"+id+"/_history/4").Code)
+	assert.Equal(http.StatusNotFound, suite.get(h, "/Patient/"+id+"/_history/5").Code)
+	assert.Equal(http.StatusNotFound, suite.get(h, "/Patient/57ec3d291445d4449de25da2/_history").Code)
+	assert.Equal(http.StatusBadRequest, suite.get(h, "/Patient/_history?_since=yesterday").Code)
+
+	w := suite.get(h, "/Patient/"+id+"/_history/2")
+	require.Equal(http.StatusOK, w.Code)
+	patient := new(models.Patient)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), patient))
+	assert.Equal("female", patient.Gender)
+
+	for _, path := range []string{"/Patient/" + id + "/_history", "/Patient/_history", "/_history?_count=2"} {
+		w = suite.get(h, path)
+		require.Equal(http.StatusOK, w.Code, path)
+		bundle := new(models.Bundle)
+		require.NoError(json.Unmarshal(w.Body.Bytes(), bundle))
+		assert.Equal(uint32(4), *bundle.Total, path)
+		assert.Equal("http://example.com/Patient/"+id, bundle.Entry[0].FullUrl, path)
+	}
+}
+
+func (suite *HistorySuite) TestIfMatch() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	for _, enableHistory := range []bool{false, true} {
+		dal, _ := suite.newServer(enableHistory)
+		id, err := dal.Post(&models.Patient{Gender: "male"})
+		require.NoError(err)
+
+		assert.Equal(server.ErrPreconditionFailed, dal.PutIfMatch(id, "2", &models.Patient{Gender: "female"}))
+		assert.NoError(dal.PutIfMatch(id, "1", &models.Patient{Gender: "female"}))
+		assert.Equal(server.ErrPreconditionFailed, dal.PutIfMatch(id, "1", &models.Patient{Gender: "other"}))
+		assert.Equal(server.ErrPreconditionFailed, dal.PutIfMatch(bson.NewObjectId().Hex(), "1", &models.Patient{}))
+
+		result, err := dal.Get(id, "Patient")
+		require.NoError(err)
+		assert.Equal("female", result.(*models.Patient).Gender)
+		assert.Equal("2", result.(*models.Patient).Meta.VersionId)
+
+		assert.Equal(server.ErrPreconditionFailed, dal.DeleteIfMatch(id, "1", "Patient"))
+		assert.NoError(dal.DeleteIfMatch(id, "2", "Patient"))
+		assert.Equal(server.ErrPreconditionFailed, dal.DeleteIfMatch(id, "2", "Patient"))
+	}
+}
+
+func (suite *HistorySuite) TestConditionalHandlers() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	h := suite.handler
+
+	id := suite.createPatientVersions()
+
+	w := suite.get(h, "/Patient/"+id)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal(`W/"3"`, w.Header().Get("ETag"))
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEmpty(lastModified)
+
+	headers := map[string]string{"If-None-Match": `W/"3"`}
+	assert.Equal(http.StatusNotModified, suite.do(h, "GET", "/Patient/"+id, headers, nil).Code)
+	headers = map[string]string{"If-None-Match": `W/"2"`}
+	assert.Equal(http.StatusOK, suite.do(h, "GET", "/Patient/"+id, headers, nil).Code)
+	headers = map[string]string{"If-Modified-Since": lastModified}
+	assert.Equal(http.StatusNotModified, suite.do(h, "GET", "/Patient/"+id, headers, nil).Code)
+	headers = map[string]string{"If-Modified-Since": "Sat, 01 Oct 2016 00:00:00 GMT"}
+	assert.Equal(http.StatusOK, suite.do(h, "GET", "/Patient/"+id, headers, nil).Code)
+
+	body := []byte(`{"resourceType": "Patient", "gender": "unknown"}`)
+	headers = map[string]string{"If-Match": `W/"2"`, "Content-Type": "application/json"}
+	assert.Equal(http.StatusPreconditionFailed, suite.do(h, "PUT", "/Patient/"+id, headers, body).Code)
+	headers["If-Match"] = `W/"3"`
+	w = suite.do(h, "PUT", "/Patient/"+id, headers, body)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal(`W/"4"`, w.Header().Get("ETag"))
+
+	headers = map[string]string{"If-Match": `W/"3"`}
+	assert.Equal(http.StatusPreconditionFailed, suite.do(h, "DELETE", "/Patient/"+id, headers, nil).Code)
+	headers["If-Match"] = `W/"4"`
+	assert.Equal(http.StatusNoContent, suite.do(h, "DELETE", "/Patient/"+id, headers, nil).Code)
+}
+
+// createPatientVersions creates a patient with three versions, returning its ID.
+func (suite *HistorySuite) createPatientVersions() string {
+	require := suite.Require()
+
+	id, err := suite.dal.Post(&models.Patient{Gender: "male"})
+	require.NoError(err)
+	_, err = suite.dal.Put(id, &models.Patient{Gender: "female"})
+	require.NoError(err)
+	_, err = suite.dal.Put(id, &models.Patient{Gender: "other"})
+	require.NoError(err)
+	return id
+}
+
+func (suite *HistorySuite) newServer(enableHistory bool) (server.DataAccessLayer, http.Handler) {
+	config := server.DefaultConfig
+	config.EnableHistory = enableHistory
+	return newTestServer(&suite.MongoSuite, nil, config)
+}
+
+func (suite *HistorySuite) links(bundle *models.Bundle) []string {
+	relations := make([]string, len(bundle.Link))
+	for i := range bundle.Link {
+		relations[i] = bundle.Link[i].Relation
+	}
+	return relations
+}
+
+func (suite *HistorySuite) get(h http.Handler, path string) *httptest.ResponseRecorder {
+	return suite.do(h, "GET", path, nil, nil)
+}
+
+func (suite *HistorySuite) do(h http.Handler, method, path string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "http://example.com"+path, bytes.NewReader(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	h.ServeHTTP(w, r)
+	return w
+}
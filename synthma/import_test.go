@@ -0,0 +1,153 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestImportSuite(t *testing.T) {
+	suite.Run(t, new(ImportSuite))
+}
+
+type ImportSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *ImportSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *ImportSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *ImportSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+const importNDJSON = `{"resourceType": "Patient", "id": "57ec3d291445d4449de25da2", "gender": "male"}
+{"resourceType": "Condition", "subject": {"reference": "Patient/57ec3d291445d4449de25da2"}}
+
+{"resourceType": "Patient", "gender": ["male"]}
+{"resourceType": "Patient", "id": "57ec3d291445d4449de25da2", "gender": "female"}
+{"resourceType": "Foo"}
+`
+
+func (suite *ImportSuite) TestImport() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	var result server.ImportResult
+	require.NoError(server.NewNDJSONImporter(suite.dal).Import("", bytes.NewBufferString(importNDJSON), &result))
+	assert.Equal(2, result.Created)
+	assert.Equal(1, result.Updated)
+	require.Len(result.Errors, 2)
+	assert.Equal(4, result.Errors[0].Line)
+	assert.Equal(6, result.Errors[1].Line)
+
+	// The supplied ID is preserved
+	patient, err := suite.dal.Get("57ec3d291445d4449de25da2", "Patient")
+	require.NoError(err)
+	assert.Equal("female", patient.(*models.Patient).Gender)
+	assert.Equal("2", patient.(*models.Patient).Meta.VersionId)
+
+	var conditions []models.Condition
+	require.NoError(server.Database.C("conditions").Find(nil).All(&conditions))
+	require.Len(conditions, 1)
+	assert.Equal("57ec3d291445d4449de25da2", conditions[0].Subject.ReferencedID)
+}
+
+// The Condition is imported before the Patient it references, neither has an ObjectId, and the last line's ID isn't
+// a valid FHIR id
+const importForeignIDsNDJSON = `{"resourceType": "Condition", "id": "c6a1e2f0-7b1d-4c55-9a0e-2d4b6f8a1c3e", "subject": {"reference": "Patient/5cbd7c5d-3a3e-4a3e-8b8a-1f2a9c3e4d5f", "display": "Jane"}}
+{"resourceType": "Patient", "id": "5cbd7c5d-3a3e-4a3e-8b8a-1f2a9c3e4d5f", "gender": "female"}
+{"resourceType": "Patient", "id": "not a valid id", "gender": "male"}
+`
+
+func (suite *ImportSuite) TestImportForeignIDs() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	var result server.ImportResult
+	importer := server.NewNDJSONImporter(suite.dal)
+	require.NoError(importer.Import("", bytes.NewBufferString(importForeignIDsNDJSON), &result))
+	assert.Equal(2, result.Created)
+	require.Len(result.Errors, 1)
+	assert.Equal(3, result.Errors[0].Line)
+
+	// The supplied IDs are preserved, so the reference resolves as is
+	patient, err := suite.dal.Get("5cbd7c5d-3a3e-4a3e-8b8a-1f2a9c3e4d5f", "Patient")
+	require.NoError(err)
+	assert.Equal("female", patient.(*models.Patient).Gender)
+	condition, err := suite.dal.Get("c6a1e2f0-7b1d-4c55-9a0e-2d4b6f8a1c3e", "Condition")
+	require.NoError(err)
+	assert.Equal("Patient/5cbd7c5d-3a3e-4a3e-8b8a-1f2a9c3e4d5f", condition.(*models.Condition).Subject.Reference)
+	assert.Equal("5cbd7c5d-3a3e-4a3e-8b8a-1f2a9c3e4d5f", condition.(*models.Condition).Subject.ReferencedID)
+	assert.Equal("Jane", condition.(*models.Condition).Subject.Display)
+
+	w := httptest.NewRecorder()
+	suite.handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/Patient/5cbd7c5d-3a3e-4a3e-8b8a-1f2a9c3e4d5f", nil))
+	assert.Equal(http.StatusOK, w.Code)
+
+	// Importing again updates the resources rather than creating copies
+	result = server.ImportResult{}
+	require.NoError(importer.Import("", bytes.NewBufferString(importForeignIDsNDJSON), &result))
+	assert.Equal(2, result.Updated)
+	count, err := server.Database.C("patients").Count()
+	require.NoError(err)
+	assert.Equal(1, count)
+}
+
+func (suite *ImportSuite) TestImportDir() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	dir, err := ioutil.TempDir("", "import")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "Patient.ndjson"), []byte(importNDJSON), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "README.txt"), []byte("Not NDJSON"), 0644))
+
+	var result server.ImportResult
+	require.NoError(server.NewNDJSONImporter(suite.dal).ImportDir(dir, &result))
+	assert.Equal(3, result.Created+result.Updated)
+	require.Len(result.Errors, 2)
+	assert.Equal("Patient.ndjson", result.Errors[0].Source)
+}
+
+func (suite *ImportSuite) TestController() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/$import", bytes.NewBufferString(importNDJSON))
+	r.Header.Set("Content-Type", "application/fhir+ndjson")
+	suite.handler.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+
+	outcome := new(models.OperationOutcome)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), outcome))
+	require.Len(outcome.Issue, 3)
+	assert.Equal("Imported 3 resources (2 created, 1 updated); 2 lines could not be imported", outcome.Issue[0].Diagnostics)
+	assert.Equal("error", outcome.Issue[1].Severity)
+
+	// The body must be NDJSON
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "http://example.com/$import", bytes.NewBufferString(`{"resourceType": "Patient"}`))
+	r.Header.Set("Content-Type", "application/json")
+	suite.handler.ServeHTTP(w, r)
+	assert.Equal(http.StatusUnsupportedMediaType, w.Code)
+}
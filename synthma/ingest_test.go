@@ -0,0 +1,133 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestIngestSuite(t *testing.T) {
+	suite.Run(t, new(IngestSuite))
+}
+
+type IngestSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *IngestSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *IngestSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *IngestSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+// The condition refers to the patient before it, the encounter refers to the patient after it, and the patient
+// refers to itself
+const ingestBundle = `{
+	"resourceType": "Bundle",
+	"type": "collection",
+	"entry": [{
+		"fullUrl": "urn:uuid:encounter",
+		"resource": {"resourceType": "Encounter", "patient": {"reference": "urn:uuid:patient"}}
+	}, {
+		"fullUrl": "urn:uuid:patient",
+		"resource": {"resourceType": "Patient", "gender": "male", "link": [{"other": {"reference": "urn:uuid:patient"}, "type": "seealso"}]}
+	}, {
+		"resource": {"resourceType": "Condition", "subject": {"reference": "urn:uuid:patient"}, "context": {"reference": "urn:uuid:encounter"}},
+		"request": {"method": "POST", "url": "Condition"}
+	}, {
+		"resource": {"resourceType": "Condition", "subject": {"reference": "urn:uuid:missing"}}
+	}]
+}`
+
+func (suite *IngestSuite) TestIngest() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	ingester := server.NewBundleIngester(suite.dal)
+	ingester.BatchSize = 2
+	var reports []server.IngestProgress
+	ingester.Progress = func(progress server.IngestProgress) {
+		reports = append(reports, progress)
+	}
+
+	progress, err := ingester.Ingest(strings.NewReader(ingestBundle))
+	require.NoError(err)
+	assert.Equal(4, progress.Entries)
+	assert.Equal(map[string]int{"Encounter": 1, "Patient": 1, "Condition": 2}, progress.Created)
+	assert.Equal(0, progress.Waiting)
+	require.Len(reports, 2)
+	assert.Equal(2, reports[0].Total())
+	assert.Equal(4, reports[1].Total())
+
+	var patients []models.Patient
+	require.NoError(server.Database.C("patients").Find(nil).All(&patients))
+	require.Len(patients, 1)
+	patientRef := "Patient/" + patients[0].Id
+	assert.Equal("1", patients[0].Meta.VersionId)
+	assert.Equal(patientRef, patients[0].Link[0].Other.Reference)
+
+	var encounters []models.Encounter
+	require.NoError(server.Database.C("encounters").Find(nil).All(&encounters))
+	require.Len(encounters, 1)
+	assert.Equal(patientRef, encounters[0].Patient.Reference)
+
+	var conditions []models.Condition
+	require.NoError(server.Database.C("conditions").Find(nil).Sort("subject.reference").All(&conditions))
+	require.Len(conditions, 2)
+	assert.Equal(patientRef, conditions[0].Subject.Reference)
+	assert.Equal("Encounter/"+encounters[0].Id, conditions[0].Context.Reference)
+	// References to entries not in the bundle are left as-is
+	assert.Equal("urn:uuid:missing", conditions[1].Subject.Reference)
+}
+
+func (suite *IngestSuite) TestController() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	w := suite.post(ingestBundle)
+	require.Equal(http.StatusOK, w.Code)
+	outcome := new(models.OperationOutcome)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), outcome))
+	assert.Equal("Created 4 resources (2 Condition, 1 Encounter, 1 Patient)", outcome.Issue[0].Diagnostics)
+
+	// Only entries creating resources can be ingested
+	w = suite.post(`{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [{
+			"resource": {"resourceType": "Patient"},
+			"request": {"method": "POST", "url": "Patient"}
+		}, {
+			"resource": {"resourceType": "Patient"},
+			"request": {"method": "PUT", "url": "Patient/57ec3d291445d4449de25da2"}
+		}]
+	}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = suite.post(`{"resourceType": "Patient"}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (suite *IngestSuite) post(body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/$ingest", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
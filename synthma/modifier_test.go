@@ -0,0 +1,170 @@
+package synthma
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestModifierSuite(t *testing.T) {
+	suite.Run(t, new(ModifierSuite))
+}
+
+type ModifierSuite struct {
+	testutil.MongoSuite
+}
+
+func (suite *ModifierSuite) SetupTest() {
+	require := suite.Require()
+	server.Database = suite.DB()
+
+	require.NoError(insertNormalized("patients",
+		&models.Patient{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+			Name:           []models.HumanName{{Family: []string{"Doe"}, Given: []string{"John"}}},
+			Gender:         "male",
+			BirthDate:      &models.FHIRDateTime{Time: time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC), Precision: models.Date},
+			Address:        []models.Address{{City: "Boston", State: "MA"}},
+			Identifier: []models.Identifier{{
+				Type:   &models.CodeableConcept{Text: "Medical record number"},
+				System: "http://hospital.example.com",
+				Value:  "12345",
+			}},
+		},
+		&models.Patient{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "2"}},
+			Name:           []models.HumanName{{Family: []string{"Doering"}, Given: []string{"Jane"}}},
+			Gender:         "female",
+		},
+		&models.Patient{DomainResource: models.DomainResource{Resource: models.Resource{Id: "3"}}},
+	))
+
+	require.NoError(server.Database.C("conditions").Insert(
+		&models.Condition{Code: &models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "44054006", Display: "Diabetes mellitus type 2"}},
+		}},
+		&models.Condition{Code: &models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "38341003", Display: "Hypertension"}},
+		}},
+		&models.Condition{Code: &models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://hl7.org/fhir/sid/icd-9-cm", Code: "250.00"}},
+			Text:   "Diabetes",
+		}},
+	))
+
+	require.NoError(server.Database.C("valuesets").Insert(
+		&models.ValueSet{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "diabetes"}},
+			Url:            "http://example.com/fhir/ValueSet/diabetes",
+			Compose: &models.ValueSetComposeComponent{
+				Include: []models.ValueSetConceptSetComponent{
+					{System: "http://snomed.info/sct", Concept: []models.ValueSetConceptReferenceComponent{{Code: "44054006"}, {Code: "46635009"}}},
+					{System: "http://hl7.org/fhir/sid/icd-9-cm", Concept: []models.ValueSetConceptReferenceComponent{{Code: "250.00"}}},
+				},
+			},
+		},
+		&models.ValueSet{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "hypertension"}},
+			Url:            "http://example.com/fhir/ValueSet/hypertension",
+			Expansion: &models.ValueSetExpansionComponent{
+				Contains: []models.ValueSetExpansionContainsComponent{
+					{Contains: []models.ValueSetExpansionContainsComponent{{System: "http://snomed.info/sct", Code: "38341003"}}},
+				},
+			},
+		},
+		&models.ValueSet{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: "other"}},
+			Url:            "http://example.org/ValueSet/other",
+		},
+	))
+}
+
+func (suite *ModifierSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *ModifierSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *ModifierSuite) TestMissing() {
+	suite.assertIDs("Patient", "address:missing=true", "2", "3")
+	suite.assertIDs("Patient", "address:missing=false", "1")
+	suite.assertIDs("Patient", "birthdate:missing=true", "2", "3")
+	suite.assertIDs("Patient", "gender:missing=true", "3")
+	suite.assertIDs("Patient", "name:missing=false&gender:missing=false", "1", "2")
+	suite.assertCount("Condition", "code:missing=false", 3)
+	suite.assertInvalid("Patient", "address:missing=sometimes")
+}
+
+func (suite *ModifierSuite) TestStringModifiers() {
+	// By default, names match the start of the string, ignoring case
+	suite.assertIDs("Patient", "name=doe", "1", "2")
+	suite.assertIDs("Patient", "name:exact=Doe", "1")
+	suite.assertIDs("Patient", "name:exact=doe")
+	suite.assertIDs("Patient", "name:contains=ERIN", "2")
+	suite.assertIDs("Patient", "address-city:contains=ost", "1")
+	suite.assertInvalid("Patient", "name:not=Doe")
+}
+
+func (suite *ModifierSuite) TestTokenModifiers() {
+	// Resources without the token match :not
+	suite.assertIDs("Patient", "gender:not=male", "2", "3")
+	suite.assertIDs("Patient", "gender:not=male,female", "3")
+	suite.assertCount("Condition", "code:not=http://snomed.info/sct|44054006", 2)
+
+	suite.assertCount("Condition", "code:text=diabetes", 2)
+	suite.assertCount("Condition", "code:text=hyper", 1)
+	suite.assertIDs("Patient", "identifier:text=medical", "1")
+	suite.assertInvalid("Patient", "gender:text=male")
+
+	suite.assertCount("Condition", "code:in=http://example.com/fhir/ValueSet/diabetes", 2)
+	suite.assertCount("Condition", "code:in=ValueSet/hypertension", 1)
+	suite.assertCount("Condition", "code:in=http://example.org/ValueSet/other", 0)
+	suite.assertCount("Condition", "code:not-in=http://example.com/fhir/ValueSet/diabetes", 1)
+	suite.assertInvalid("Condition", "code:in=http://example.com/fhir/ValueSet/unknown")
+}
+
+func (suite *ModifierSuite) TestURIModifiers() {
+	suite.assertCount("ValueSet", "url=http://example.com/fhir", 0)
+	suite.assertCount("ValueSet", "url:below=http://example.com/fhir", 2)
+	suite.assertCount("ValueSet", "url:below=http://example.org", 1)
+	suite.assertCount("ValueSet", "url:above=http://example.com/fhir/ValueSet/diabetes", 1)
+	suite.assertCount("ValueSet", "url:above=http://example.org/ValueSet/other/_history/1", 1)
+}
+
+func (suite *ModifierSuite) assertCount(resource, query string, expected int) {
+	q := search.Query{Resource: resource, Query: query}
+	count, err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Count()
+	suite.Require().NoError(err)
+	suite.Assert().Equal(expected, count, query)
+}
+
+func (suite *ModifierSuite) assertIDs(resource, query string, expected ...string) {
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: resource, Query: query}
+	err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Sort("_id").All(&results)
+	suite.Require().NoError(err)
+	IDs := make([]string, 0, len(results))
+	for _, result := range results {
+		IDs = append(IDs, result.ID)
+	}
+	if expected == nil {
+		expected = []string{}
+	}
+	suite.Assert().Equal(expected, IDs, query)
+}
+
+func (suite *ModifierSuite) assertInvalid(resource, query string) {
+	q := search.Query{Resource: resource, Query: query}
+	suite.Assert().Panics(func() {
+		search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q)
+	}, query)
+}
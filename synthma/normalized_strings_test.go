@@ -0,0 +1,194 @@
+package synthma
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNormalizedStringsSuite(t *testing.T) {
+	suite.Run(t, new(NormalizedStringsSuite))
+}
+
+func TestNormalizeStringSuite(t *testing.T) {
+	suite.Run(t, new(NormalizeStringSuite))
+}
+
+// NormalizeStringSuite tests normalizing strings, which doesn't need a database
+type NormalizeStringSuite struct {
+	suite.Suite
+}
+
+func (suite *NormalizeStringSuite) TestNormalizeString() {
+	tests := []struct {
+		s, expected string
+	}{
+		{"", ""},
+		{"doe", "doe"},
+		{"Jos\u00e9", "jose"},
+		{"JOS\u00c9", "jose"},
+		// Decomposed accents are combining marks, which are dropped
+		{"Jose\u0301", "jose"},
+		{"Straße", "strasse"},
+		{"Ærøskøbing", "aeroskobing"},
+		{"Łódź 90-001", "lodz 90-001"},
+		{"Œuvre", "oeuvre"},
+		// Letters outside the Latin blocks are only lowercased
+		{"ΑΘΗΝΑ", "αθηνα"},
+	}
+
+	for _, test := range tests {
+		suite.Equal(test.expected, search.NormalizeString(test.s), test.s)
+	}
+}
+
+type NormalizedStringsSuite struct {
+	testutil.MongoSuite
+	dal server.DataAccessLayer
+}
+
+func (suite *NormalizedStringsSuite) SetupTest() {
+	suite.dal, _ = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *NormalizedStringsSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *NormalizedStringsSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *NormalizedStringsSuite) TestCreateAndUpdate() {
+	require := suite.Require()
+
+	id, err := suite.dal.Post(&models.Patient{
+		Name:    []models.HumanName{{Family: []string{"Núñez"}, Given: []string{"José"}}},
+		Address: []models.Address{{City: "São Paulo"}},
+	})
+	require.NoError(err)
+	suite.assertIDs("name=jose", id)
+	suite.assertIDs("name=JOSÉ", id)
+	suite.assertIDs("family=nun", id)
+	suite.assertIDs("address-city=sao", id)
+	suite.assertIDs("name=maria")
+
+	_, err = suite.dal.Put(id, &models.Patient{
+		Name:    []models.HumanName{{Family: []string{"Núñez"}, Given: []string{"María"}}},
+		Address: []models.Address{{City: "São Paulo"}},
+	})
+	require.NoError(err)
+	suite.assertIDs("name=jose")
+	suite.assertIDs("name=maria", id)
+
+	// The normalized values are only used for searching
+	result, err := suite.dal.Get(id, "Patient")
+	require.NoError(err)
+	suite.Assert().Equal("María", result.(*models.Patient).Name[0].Given[0])
+}
+
+func (suite *NormalizedStringsSuite) TestModifiers() {
+	require := suite.Require()
+
+	require.NoError(suite.dal.BulkPost([]interface{}{
+		&models.Patient{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: bson.NewObjectId().Hex()}},
+			Name:           []models.HumanName{{Family: []string{"Gómez-Ortiz"}}},
+		},
+		&models.Patient{
+			DomainResource: models.DomainResource{Resource: models.Resource{Id: bson.NewObjectId().Hex()}},
+			Name:           []models.HumanName{{Family: []string{"Ortiz"}}},
+		},
+	}))
+	suite.assertCount("family=ortiz", 1)
+	suite.assertCount("family:contains=ORTIZ", 2)
+	suite.assertCount("family:contains=mez-o", 1)
+	// Exact matches compare the original values
+	suite.assertCount("family:exact=Gómez-Ortiz", 1)
+	suite.assertCount("family:exact=gomez-ortiz", 0)
+}
+
+func (suite *NormalizedStringsSuite) TestReindex() {
+	require := suite.Require()
+
+	// Resources saved without normalized values aren't found until they're reindexed
+	require.NoError(server.Database.C("patients").Insert(&models.Patient{
+		DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+		Name:           []models.HumanName{{Given: []string{"Zoë"}}},
+	}))
+	suite.assertIDs("given=zoe")
+
+	count, err := server.ReindexNormalizedValues(server.Database)
+	require.NoError(err)
+	suite.Assert().Equal(1, count)
+	suite.assertIDs("given=zoe", "1")
+}
+
+func (suite *NormalizedStringsSuite) TestBackfill() {
+	require := suite.Require()
+
+	// Resources saved by earlier versions of the server are given normalized values on startup
+	require.NoError(server.Database.C("patients").Insert(&models.Patient{
+		DomainResource: models.DomainResource{Resource: models.Resource{Id: "1"}},
+		Name:           []models.HumanName{{Given: []string{"Zoë"}}},
+		Address:        []models.Address{{City: "Bogotá"}},
+	}))
+	id, err := suite.dal.Post(&models.Patient{Name: []models.HumanName{{Given: []string{"Zoe"}}}})
+	require.NoError(err)
+	suite.assertIDs("given=zoe", id)
+
+	count, err := server.BackfillNormalizedValues(server.Database)
+	require.NoError(err)
+	suite.Assert().Equal(1, count)
+	suite.assertIDs("given=zoe", "1", id)
+	suite.assertIDs("address-city=bogota", "1")
+
+	// Each collection is only backfilled once
+	count, err = server.BackfillNormalizedValues(server.Database)
+	require.NoError(err)
+	suite.Assert().Equal(0, count)
+}
+
+func (suite *NormalizedStringsSuite) assertCount(query string, expected int) {
+	q := search.Query{Resource: "Patient", Query: query}
+	count, err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Count()
+	suite.Require().NoError(err)
+	suite.Assert().Equal(expected, count, query)
+}
+
+func (suite *NormalizedStringsSuite) assertIDs(query string, expected ...string) {
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: "Patient", Query: query}
+	err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Sort("_id").All(&results)
+	suite.Require().NoError(err)
+	IDs := make([]string, 0, len(results))
+	for _, result := range results {
+		IDs = append(IDs, result.ID)
+	}
+	if expected == nil {
+		expected = []string{}
+	}
+	suite.Assert().Equal(expected, IDs, query)
+}
+
+// insertNormalized inserts the resources as the server stores them, with the normalized values of their string
+// search parameters.
+func insertNormalized(collection string, resources ...interface{}) error {
+	var docs []interface{}
+	for _, resource := range resources {
+		doc, err := server.NormalizedDocument(reflect.TypeOf(resource).Elem().Name(), resource)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+	return server.Database.C(collection).Insert(docs...)
+}
@@ -0,0 +1,259 @@
+package synthma
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPagingSuite(t *testing.T) {
+	suite.Run(t, new(PagingSuite))
+}
+
+func TestCursorSuite(t *testing.T) {
+	suite.Run(t, new(CursorSuite))
+}
+
+// CursorSuite tests decoding cursors, which doesn't need a database
+type CursorSuite struct {
+	suite.Suite
+}
+
+func (suite *CursorSuite) TestParseCursor() {
+	id := bson.ObjectIdHex("57ec3d291445d4449de25da2")
+	valid := suite.encode(bson.M{"v": []interface{}{"doe", id}})
+
+	tests := []struct {
+		name, s string
+		valid   bool
+	}{
+		{"valid", valid, true},
+		{"padded", valid + "==", false},
+		{"not base64", "not a cursor!", false},
+		{"not BSON", base64.RawURLEncoding.EncodeToString([]byte("cursor")), false},
+		{"no values", suite.encode(bson.M{"v": []interface{}{}}), false},
+		{"empty", "", false},
+	}
+
+	for _, test := range tests {
+		cursor, err := search.ParseCursor(test.s)
+		if !test.valid {
+			suite.Error(err, test.name)
+			suite.Nil(cursor, test.name)
+			continue
+		}
+		if suite.NoError(err, test.name) {
+			suite.Equal(valid, cursor.String(), test.name)
+			suite.Require().Len(cursor.Values, 2)
+			var family string
+			var lastID bson.ObjectId
+			suite.NoError(cursor.Values[0].Unmarshal(&family))
+			suite.NoError(cursor.Values[1].Unmarshal(&lastID))
+			suite.Equal("doe", family)
+			suite.Equal(id, lastID)
+		}
+	}
+}
+
+func (suite *CursorSuite) encode(doc bson.M) string {
+	data, err := bson.Marshal(doc)
+	suite.Require().NoError(err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+type PagingSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *PagingSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *PagingSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *PagingSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *PagingSuite) TestCursorPaging() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	genders := []string{"male", "female", "male", "", "female"}
+	for _, gender := range genders {
+		suite.post(gender)
+	}
+
+	// Each page continues where the last left off, even when the sort values are repeated or missing
+	for _, sort := range []string{"", "&_sort=gender", "&_sort=-gender"} {
+		bundle := suite.search("/Patient?_count=2" + sort)
+		require.NotNil(bundle.Total)
+		assert.Equal(uint32(5), *bundle.Total)
+		assert.Contains(linkURL(bundle, "last"), "_offset=4")
+
+		var IDs []string
+		pages := 0
+		for {
+			pages++
+			for _, entry := range bundle.Entry {
+				IDs = append(IDs, entry.Resource.(*models.Patient).Id)
+			}
+			next := linkURL(bundle, "next")
+			if next == "" {
+				break
+			}
+			assert.Contains(next, search.CursorParam+"=")
+			assert.NotContains(next, "_offset=2")
+			bundle = suite.search(next)
+		}
+		assert.Equal(3, pages, sort)
+		assert.Len(IDs, 5, sort)
+		assert.Len(uniqueStrings(IDs), 5, sort)
+	}
+
+	// A full page is followed by more results if new resources are created
+	bundle := suite.search("/Patient?_count=5")
+	assert.Empty(linkURL(bundle, "next"))
+	bundle = suite.search("/Patient?_count=3")
+	next := linkURL(bundle, "next")
+	suite.post("male")
+	bundle = suite.search(next)
+	assert.Len(bundle.Entry, 3)
+}
+
+func (suite *PagingSuite) TestOffsetPaging() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	for i := 0; i < 5; i++ {
+		suite.post("male")
+	}
+
+	bundle := suite.search("/Patient?_count=2&_offset=2")
+	require.Len(bundle.Entry, 2)
+	assert.Contains(linkURL(bundle, "previous"), "_offset=0")
+	assert.Contains(linkURL(bundle, "next"), "_offset=4")
+	assert.NotContains(linkURL(bundle, "next"), search.CursorParam)
+
+	// Cursors can't be used when sorting on an element that may repeat
+	bundle = suite.search("/Patient?_count=2&_sort=family")
+	assert.Contains(linkURL(bundle, "next"), "_offset=2")
+}
+
+func (suite *PagingSuite) TestTotal() {
+	assert := suite.Assert()
+
+	for i := 0; i < 3; i++ {
+		suite.post("male")
+	}
+
+	bundle := suite.search("/Patient?_count=2&_total=none")
+	assert.Nil(bundle.Total)
+	assert.NotEmpty(linkURL(bundle, "next"))
+	assert.Empty(linkURL(bundle, "last"))
+	assert.Contains(linkURL(bundle, "next"), "_total=none")
+
+	bundle = suite.search("/Patient?_count=2&_total=estimate")
+	suite.Require().NotNil(bundle.Total)
+	assert.Equal(uint32(3), *bundle.Total)
+
+	assert.Equal(http.StatusBadRequest, suite.get("/Patient?_total=maybe").Code)
+	assert.Equal(http.StatusBadRequest, suite.get("/Patient?_cursor=invalid").Code)
+}
+
+func (suite *PagingSuite) TestStoredSearch() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	config := server.DefaultConfig
+	config.EnableStoredSearches = true
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, config)
+
+	var IDs []string
+	for i := 0; i < 5; i++ {
+		IDs = append(IDs, suite.post("male"))
+	}
+
+	// Only searches that can't be paged by cursor are stored
+	bundle := suite.search("/Patient?gender=male&_count=2")
+	assert.Contains(linkURL(bundle, "next"), search.CursorParam+"=")
+	bundle = suite.search("/Patient?gender=male&_count=2&_sort=family")
+	require.Len(bundle.Entry, 2)
+	assert.Equal(uint32(5), *bundle.Total)
+	next := linkURL(bundle, "next")
+	assert.Contains(next, search.GetPagesParam+"=")
+
+	// The pages don't change as resources are created and deleted
+	suite.post("male")
+	require.NoError(suite.dal.Delete(IDs[3], "Patient"))
+	bundle = suite.search(next)
+	assert.Equal(uint32(5), *bundle.Total)
+	require.Len(bundle.Entry, 1)
+	assert.Equal(IDs[2], bundle.Entry[0].Resource.(*models.Patient).Id)
+	bundle = suite.search(linkURL(bundle, "next"))
+	require.Len(bundle.Entry, 1)
+	assert.Equal(IDs[4], bundle.Entry[0].Resource.(*models.Patient).Id)
+	assert.Empty(linkURL(bundle, "next"))
+
+	// Searches with only one page, or too many results, aren't stored
+	bundle = suite.search("/Patient?gender=male&_count=10&_sort=family")
+	assert.Len(bundle.Entry, 5)
+	assert.NotContains(linkURL(bundle, "self"), search.GetPagesParam)
+	defer func(max int) { server.MaxStoredSearchResults = max }(server.MaxStoredSearchResults)
+	server.MaxStoredSearchResults = 4
+	bundle = suite.search("/Patient?gender=male&_count=2&_sort=family")
+	assert.Len(bundle.Entry, 2)
+	assert.Contains(linkURL(bundle, "next"), "_offset=2")
+	n, err := suite.DB().C("searchresults").Find(bson.M{"index": 0}).Count()
+	require.NoError(err)
+	assert.Equal(1, n)
+
+	assert.Equal(http.StatusGone, suite.get("/Patient?_getpages=57ec3d291445d4449de25da2").Code)
+}
+
+func (suite *PagingSuite) post(gender string) string {
+	id, err := suite.dal.Post(&models.Patient{Gender: gender})
+	suite.Require().NoError(err)
+	return id
+}
+
+func (suite *PagingSuite) get(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
+
+func (suite *PagingSuite) search(path string) *models.Bundle {
+	w := suite.get(path)
+	suite.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	bundle := new(models.Bundle)
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), bundle))
+	return bundle
+}
+
+// linkURL returns the URL of the bundle's link with the relation (without the host), or an empty string if it has
+// none.
+func linkURL(bundle *models.Bundle, relation string) string {
+	for _, link := range bundle.Link {
+		if link.Relation == relation {
+			u, _ := url.Parse(link.Url)
+			return u.RequestURI()
+		}
+	}
+	return ""
+}
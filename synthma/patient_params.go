@@ -0,0 +1,410 @@
+package synthma
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	// Register the medication-code, procedure-code, and immunization-code parameters
+	for _, info := range []search.SearchParamInfo{MedicationCodeParamInfo, ProcedureCodeParamInfo, ImmunizationCodeParamInfo} {
+		search.GlobalRegistry().RegisterParameterInfo(info)
+		search.GlobalRegistry().RegisterParameterParser(info.Type, PatientCodeParamParser)
+		search.GlobalMongoRegistry().RegisterPipelineBuilder(info.Type, PatientCodePipelineBuilder)
+		search.GlobalMongoRegistry().RegisterSourceBuilder(info.Type, PatientCodeSourceBuilder)
+	}
+
+	// Register the observation-code-value parameter
+	search.GlobalRegistry().RegisterParameterInfo(ObservationCodeValueParamInfo)
+	search.GlobalRegistry().RegisterParameterParser(ObservationCodeValueParamInfo.Type, ObservationCodeValueParamParser)
+	search.GlobalMongoRegistry().RegisterPipelineBuilder(ObservationCodeValueParamInfo.Type, ObservationCodeValuePipelineBuilder)
+	search.GlobalMongoRegistry().RegisterSourceBuilder(ObservationCodeValueParamInfo.Type, ObservationCodeValueSourceBuilder)
+}
+
+// PatientCodeParam represents the medication-code, procedure-code, and immunization-code search
+// parameters. Patient's may be searched by the medications they were ordered, the procedures they
+// had, and the immunizations they received. These behave exactly the same as condition-code,
+// including the :not and :text modifiers. See ConditionCodeParam.
+//
+// Each Item is a *search.TokenParam, or a *search.StringParam when using the :text modifier.
+type PatientCodeParam struct {
+	search.OrParam
+}
+
+// MedicationCodeParamInfo represents the medication codes of Patients' medication orders.
+var MedicationCodeParamInfo = search.SearchParamInfo{
+	Resource: "Patient",
+	Name:     "medication-code",
+	Type:     "synthma.patient_medication_code",
+}
+
+// ProcedureCodeParamInfo represents the codes of Patients' procedures.
+var ProcedureCodeParamInfo = search.SearchParamInfo{
+	Resource: "Patient",
+	Name:     "procedure-code",
+	Type:     "synthma.patient_procedure_code",
+}
+
+// ImmunizationCodeParamInfo represents the vaccine codes of Patients' immunizations.
+var ImmunizationCodeParamInfo = search.SearchParamInfo{
+	Resource: "Patient",
+	Name:     "immunization-code",
+	Type:     "synthma.patient_immunization_code",
+}
+
+// patientCodeJoins maps each PatientCodeParam type to how its resources are joined to patients.
+var patientCodeJoins = map[string]patientJoin{
+	MedicationCodeParamInfo.Type:   {Collection: "medicationorders", PatientField: "patient", CodeField: "medicationCodeableConcept"},
+	ProcedureCodeParamInfo.Type:    {Collection: "procedures", PatientField: "subject", CodeField: "code"},
+	ImmunizationCodeParamInfo.Type: {Collection: "immunizations", PatientField: "patient", CodeField: "vaccineCode"},
+}
+
+// PatientCodeParamParser parses the parameter and returns a PatientCodeParam.
+var PatientCodeParamParser = func(info search.SearchParamInfo, data search.SearchParamData) (search.SearchParam, error) {
+	items, err := parseCodeItems(info, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PatientCodeParam{
+		OrParam: search.OrParam{SearchParamInfo: info, Items: items},
+	}, nil
+}
+
+// PatientCodeSourceBuilder builds the pipeline source corresponding to the query by Patient
+// medication, procedure, or immunization.  See ConditionCodeSourceBuilder.
+var PatientCodeSourceBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) (*search.PipelineSource, error) {
+	join, ors, not, err := patientCodeOrs(param)
+	if err != nil {
+		return nil, err
+	}
+	return join.source(ors, not), nil
+}
+
+// PatientCodePipelineBuilder builds the aggregation pipeline stages corresponding to the query by
+// Patient medication, procedure, or immunization.  See ConditionCodePipelineBuilder.
+var PatientCodePipelineBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) ([]bson.M, error) {
+	join, ors, not, err := patientCodeOrs(param)
+	if err != nil {
+		return nil, err
+	}
+	return join.stages(ors, not), nil
+}
+
+// patientCodeOrs returns how the resources searched by a PatientCodeParam are joined to patients,
+// the criteria for resources matching each of its values, and whether the patients must have none
+// of them.
+func patientCodeOrs(param search.SearchParam) (join patientJoin, ors []bson.M, not bool, err error) {
+	pc, ok := param.(*PatientCodeParam)
+	if !ok {
+		return join, nil, false, errors.New("Expected a PatientCodeParam")
+	}
+	join, ok = patientCodeJoins[pc.Type]
+	if !ok {
+		return join, nil, false, fmt.Errorf("Unknown patient code parameter type: %s", pc.Type)
+	}
+
+	ors = make([]bson.M, len(pc.Items))
+	for i, item := range pc.Items {
+		if ors[i], err = codeCriteria(join.CodeField, item); err != nil {
+			return join, nil, false, err
+		}
+	}
+	return join, ors, pc.Modifier == "not", nil
+}
+
+// ObservationCodeValueParam represents the observation-code-value search parameter. Patient's may
+// be searched by the values of their observations, using composite values of the form
+// [system|]code$[prefix]number[|system|code] (e.g., http://loinc.org|8480-6$gt140). The number
+// supports the eq (default), ne, gt, lt, ge, and le prefixes, and is compared to the value of
+// the observation itself or the value of any of its components (e.g., the systolic component of
+// a blood pressure panel). Multiple comma-separated values match any of them, and the :not modifier
+// matches patients having no observation with any of the values.
+//
+// Each Item is a *search.CompositeParam of the token and the quantity.
+type ObservationCodeValueParam struct {
+	search.OrParam
+}
+
+// ObservationCodeValueParamInfo represents the codes and values of Patients' observations.
+var ObservationCodeValueParamInfo = search.SearchParamInfo{
+	Resource: "Patient",
+	Name:     "observation-code-value",
+	Type:     "synthma.patient_observation_code_value",
+}
+
+// observationJoin describes how observations reference their patients.
+var observationJoin = patientJoin{Collection: "observations", PatientField: "subject"}
+
+// ObservationCodeValueParamParser parses the parameter and returns an ObservationCodeValueParam.
+var ObservationCodeValueParamParser = func(info search.SearchParamInfo, data search.SearchParamData) (search.SearchParam, error) {
+	if data.Modifier != "" && data.Modifier != "not" {
+		return nil, unsupportedModifierError(info)
+	}
+
+	values := search.SplitParamValue(data.Value, ',')
+	items := make([]search.SearchParam, len(values))
+	for i, value := range values {
+		composite := search.ParseCompositeParam(value, info)
+		if len(composite.CompositeValues) != 2 || composite.CompositeValues[0] == "" {
+			return nil, invalidParamError(info, "must be of the form [system|]code$[prefix]number[|system|code]")
+		}
+		quantity := search.ParseQuantityParam(composite.CompositeValues[1], info)
+		if quantity.Number.Value == nil {
+			return nil, invalidParamError(info, "must be of the form [system|]code$[prefix]number[|system|code]")
+		}
+		if _, err := quantityCriteria("valueQuantity", quantity); err != nil {
+			return nil, err
+		}
+		items[i] = composite
+	}
+
+	return &ObservationCodeValueParam{
+		OrParam: search.OrParam{SearchParamInfo: info, Items: items},
+	}, nil
+}
+
+// ObservationCodeValueSourceBuilder builds the pipeline source corresponding to the query by Patient
+// observation value.  See ConditionCodeSourceBuilder.
+var ObservationCodeValueSourceBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) (*search.PipelineSource, error) {
+	ors, not, err := observationCodeValueOrs(param)
+	if err != nil {
+		return nil, err
+	}
+	return observationJoin.source(ors, not), nil
+}
+
+// ObservationCodeValuePipelineBuilder builds the aggregation pipeline stages corresponding to the
+// query by Patient observation value.  See ConditionCodePipelineBuilder.
+var ObservationCodeValuePipelineBuilder = func(param search.SearchParam, searcher *search.MongoSearcher) ([]bson.M, error) {
+	ors, not, err := observationCodeValueOrs(param)
+	if err != nil {
+		return nil, err
+	}
+	return observationJoin.stages(ors, not), nil
+}
+
+// observationCodeValueOrs returns the criteria for observations matching each of the values of an
+// ObservationCodeValueParam, and whether the patients must have none of them.
+func observationCodeValueOrs(param search.SearchParam) (ors []bson.M, not bool, err error) {
+	ov, ok := param.(*ObservationCodeValueParam)
+	if !ok {
+		return nil, false, errors.New("Expected an ObservationCodeValueParam")
+	}
+
+	ors = make([]bson.M, len(ov.Items))
+	for i, item := range ov.Items {
+		composite, ok := item.(*search.CompositeParam)
+		if !ok {
+			return nil, false, fmt.Errorf("Unexpected observation code value: %T", item)
+		}
+		token := search.ParseTokenParam(composite.CompositeValues[0], ov.SearchParamInfo)
+		quantity := search.ParseQuantityParam(composite.CompositeValues[1], ov.SearchParamInfo)
+		value, err := quantityCriteria("valueQuantity", quantity)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// The code and value must both match the observation, or both match the same component
+		observation := codingCriteria("code", token)
+		component := codingCriteria("code", token)
+		for k, v := range value {
+			observation[k] = v
+			component[k] = v
+		}
+		ors[i] = bson.M{
+			"$or": []bson.M{
+				observation,
+				{"component": bson.M{"$elemMatch": component}},
+			},
+		}
+	}
+	return ors, ov.Modifier == "not", nil
+}
+
+// patientJoin describes how the resources matched by a Patient search parameter reference the
+// patient, so that the patients having matching resources can be found.
+type patientJoin struct {
+	Collection   string // the collection the resources are stored in (e.g., "conditions")
+	PatientField string // the resources' reference to the patient (e.g., "subject")
+	CodeField    string // the resources' CodeableConcept matched by the parameter (e.g., "code")
+}
+
+// criteria returns the query matching the resources that match any of the passed in criteria and
+// reference a patient.
+func (j patientJoin) criteria(ors []bson.M) bson.M {
+	criteria := bson.M{"$or": ors}
+	if len(ors) == 1 {
+		criteria = ors[0]
+	}
+	criteria[j.PatientField+".type"] = "Patient"
+	return criteria
+}
+
+// source returns the pipeline source that finds the patients having a resource that matches any of
+// the passed in criteria, by matching the resources (using the indexes on their codes), grouping
+// them by patient, and then looking up each patient.  The cost is proportional to the number of
+// matching resources, rather than the number of patients.  Patients can only be found this way
+// when they must have a matching resource, so it returns nil if not is true.
+func (j patientJoin) source(ors []bson.M, not bool) *search.PipelineSource {
+	if not {
+		return nil
+	}
+	return &search.PipelineSource{
+		Collection: j.Collection,
+		Stages: []bson.M{
+			{"$match": j.criteria(ors)},
+			{"$group": bson.M{"_id": "$" + j.PatientField + ".referenceid"}},
+			{"$lookup": bson.M{
+				"from":         "patients",
+				"localField":   "_id",
+				"foreignField": "_id",
+				"as":           "_synthmaPatient",
+			}},
+			{"$unwind": "$_synthmaPatient"},
+			{"$replaceRoot": bson.M{"newRoot": "$_synthmaPatient"}},
+		},
+	}
+}
+
+// stages returns the pipeline stages that join each patient's resources and match the patients
+// having a resource that matches any of the passed in criteria (or, if not is true, the patients
+// having no such resource).  The joined resources are removed again by the last stage.  Since every
+// patient remaining after the query's other parameters is joined, these stages are only used when
+// the patients can't be found using the source.
+func (j patientJoin) stages(ors []bson.M, not bool) []bson.M {
+	match := bson.M{"$elemMatch": j.criteria(ors)}
+	if not {
+		match = bson.M{"$not": match}
+	}
+
+	field := "_synthma" + strings.Title(j.Collection)
+	return []bson.M{
+		{"$lookup": bson.M{
+			"from":         j.Collection,
+			"localField":   "_id",
+			"foreignField": j.PatientField + ".referenceid",
+			"as":           field,
+		}},
+		{"$match": bson.M{field: match}},
+		{"$project": bson.M{field: 0}},
+	}
+}
+
+// parseCodeItems parses the comma-separated values of a code parameter supporting the :not and
+// :text modifiers, returning a *search.TokenParam (or *search.StringParam for :text) for each.
+func parseCodeItems(info search.SearchParamInfo, data search.SearchParamData) ([]search.SearchParam, error) {
+	if data.Modifier != "" && data.Modifier != "not" && data.Modifier != "text" {
+		return nil, unsupportedModifierError(info)
+	}
+
+	values := search.SplitParamValue(data.Value, ',')
+	items := make([]search.SearchParam, len(values))
+	for i, value := range values {
+		if data.Modifier == "text" {
+			items[i] = search.ParseStringParam(value, info)
+		} else {
+			items[i] = search.ParseTokenParam(value, info)
+		}
+	}
+	return items, nil
+}
+
+// codeCriteria returns the query matching a single item parsed by parseCodeItems against the
+// CodeableConcept in the given field.
+func codeCriteria(field string, item search.SearchParam) (bson.M, error) {
+	switch item := item.(type) {
+	case *search.TokenParam:
+		return codingCriteria(field, item), nil
+	case *search.StringParam:
+		text := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(item.String), Options: "i"}
+		return bson.M{
+			"$or": []bson.M{
+				{field + ".text": text},
+				{field + ".coding.display": text},
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("Unexpected code value: %T", item)
+}
+
+// codingCriteria returns the query matching a token against the codings of the CodeableConcept in
+// the given field.  The system and code are matched using $elemMatch so that both must match the
+// same coding.
+func codingCriteria(field string, token *search.TokenParam) bson.M {
+	switch {
+	case token.AnySystem:
+		return bson.M{field + ".coding.code": token.Code}
+	case token.Code == "":
+		// system| matches any code in the system
+		return bson.M{field + ".coding.system": token.System}
+	case token.System == "":
+		// |code matches codes without a system
+		return bson.M{field + ".coding": bson.M{"$elemMatch": bson.M{"system": bson.M{"$exists": false}, "code": token.Code}}}
+	default:
+		return bson.M{field + ".coding": bson.M{"$elemMatch": bson.M{"system": token.System, "code": token.Code}}}
+	}
+}
+
+// quantityCriteria returns the query matching a quantity against the Quantity in the given field.
+// As with standard number parameters, eq and ne use the range implied by the number's precision
+// (e.g., 100 means [99.5, 100.5)), while the other prefixes compare against the exact number.
+func quantityCriteria(field string, q *search.QuantityParam) (bson.M, error) {
+	l, _ := q.Number.RangeLowIncl().Float64()
+	h, _ := q.Number.RangeHighExcl().Float64()
+	n, _ := q.Number.Value.Float64()
+
+	var value bson.M
+	switch q.Prefix {
+	case search.EQ:
+		value = bson.M{"$gte": l, "$lt": h}
+	case search.NE:
+		value = bson.M{"$exists": true, "$not": bson.M{"$gte": l, "$lt": h}}
+	case search.GT:
+		value = bson.M{"$gt": n}
+	case search.LT:
+		value = bson.M{"$lt": n}
+	case search.GE:
+		value = bson.M{"$gte": n}
+	case search.LE:
+		value = bson.M{"$lte": n}
+	default:
+		return nil, &search.Error{
+			HTTPStatus:       http.StatusNotImplemented,
+			OperationOutcome: models.NewOperationOutcome("error", "not-supported", fmt.Sprintf("Parameter \"%s\" prefix is not supported", q.Name)),
+		}
+	}
+
+	criteria := bson.M{field + ".value": value}
+	if q.System != "" {
+		criteria[field+".system"] = q.System
+		criteria[field+".code"] = q.Code
+	} else if q.Code != "" {
+		criteria["$or"] = []bson.M{
+			{field + ".code": q.Code},
+			{field + ".unit": q.Code},
+		}
+	}
+	return criteria, nil
+}
+
+func unsupportedModifierError(info search.SearchParamInfo) error {
+	return &search.Error{
+		HTTPStatus:       http.StatusNotImplemented,
+		OperationOutcome: models.NewOperationOutcome("error", "not-supported", fmt.Sprintf("Parameter \"%s\" modifier is invalid", info.Name)),
+	}
+}
+
+func invalidParamError(info search.SearchParamInfo, reason string) error {
+	return &search.Error{
+		HTTPStatus:       http.StatusBadRequest,
+		OperationOutcome: models.NewOperationOutcome("error", "invalid", fmt.Sprintf("Parameter \"%s\" %s", info.Name, reason)),
+	}
+}
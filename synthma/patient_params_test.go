@@ -0,0 +1,147 @@
+package synthma
+
+import (
+	"sort"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestPatientParamsSuite(t *testing.T) {
+	suite.Run(t, new(PatientParamsSuite))
+}
+
+type PatientParamsSuite struct {
+	testutil.MongoSuite
+}
+
+func (suite *PatientParamsSuite) SetupTest() {
+	server.Database = suite.DB()
+}
+
+func (suite *PatientParamsSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *PatientParamsSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *PatientParamsSuite) TestPatientCodeParamParser() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	p, err := PatientCodeParamParser(ProcedureCodeParamInfo, search.SearchParamData{Value: "http://snomed.info/sct|73761001,76601001"})
+	require.NoError(err)
+	require.IsType(new(PatientCodeParam), p)
+	items := p.(*PatientCodeParam).Items
+	require.Len(items, 2)
+	assert.Equal("http://snomed.info/sct", items[0].(*search.TokenParam).System)
+	assert.Equal("73761001", items[0].(*search.TokenParam).Code)
+	assert.Equal("76601001", items[1].(*search.TokenParam).Code)
+}
+
+func (suite *PatientParamsSuite) TestObservationCodeValueParamParser() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	p, err := ObservationCodeValueParamParser(ObservationCodeValueParamInfo, search.SearchParamData{Value: "http://loinc.org|8480-6$gt140"})
+	require.NoError(err)
+	require.IsType(new(ObservationCodeValueParam), p)
+	require.Len(p.(*ObservationCodeValueParam).Items, 1)
+	assert.Equal([]string{"http://loinc.org|8480-6", "gt140"}, p.(*ObservationCodeValueParam).Items[0].(*search.CompositeParam).CompositeValues)
+
+	for _, value := range []string{"8480-6", "8480-6$", "$140", "8480-6$high", "8480-6$sa140"} {
+		_, err = ObservationCodeValueParamParser(ObservationCodeValueParamInfo, search.SearchParamData{Value: value})
+		assert.Error(err, value)
+	}
+}
+
+func (suite *PatientParamsSuite) TestMedicationCodeSearch() {
+	suite.insertPatients()
+	suite.insertCoded("medicationorders", "patient", "medicationCodeableConcept", "57ec3d291445d4449de25da2", "http://www.nlm.nih.gov/research/umls/rxnorm", "834060")
+	suite.insertCoded("medicationorders", "patient", "medicationCodeableConcept", "57ed3d291445d4449de25da2", "http://www.nlm.nih.gov/research/umls/rxnorm", "313782")
+
+	suite.assertPatientIDs("medication-code=http://www.nlm.nih.gov/research/umls/rxnorm|834060", "57ec3d291445d4449de25da2")
+	suite.assertPatientIDs("medication-code=834060,313782", "57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2")
+	suite.assertPatientIDs("medication-code=http://snomed.info/sct|834060")
+}
+
+func (suite *PatientParamsSuite) TestProcedureCodeSearch() {
+	suite.insertPatients()
+	suite.insertCoded("procedures", "subject", "code", "57ef3d291445d4449de25da2", "http://snomed.info/sct", "73761001")
+
+	suite.assertPatientIDs("procedure-code=http://snomed.info/sct|73761001", "57ef3d291445d4449de25da2")
+	suite.assertPatientIDs("procedure-code:not=73761001", "57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2",
+		"57eg3d291445d4449de25da2")
+}
+
+func (suite *PatientParamsSuite) TestImmunizationCodeSearch() {
+	suite.insertPatients()
+	suite.insertCoded("immunizations", "patient", "vaccineCode", "57eg3d291445d4449de25da2", "http://hl7.org/fhir/sid/cvx", "140")
+
+	suite.assertPatientIDs("immunization-code=http://hl7.org/fhir/sid/cvx|140", "57eg3d291445d4449de25da2")
+	suite.assertPatientIDs("immunization-code:text=test%20immun", "57eg3d291445d4449de25da2")
+}
+
+func (suite *PatientParamsSuite) TestObservationCodeValueSearch() {
+	suite.insertPatients()
+	var observations []models.Observation
+	suite.InsertFixture("observations", "../fixtures/observations.json", &observations)
+
+	// Systolic blood pressure is a component of the first two observations, and the value of the third
+	suite.assertPatientIDs("observation-code-value=http://loinc.org|8480-6$gt140", "57ec3d291445d4449de25da2", "57ef3d291445d4449de25da2")
+	suite.assertPatientIDs("observation-code-value=8480-6$lt130", "57ed3d291445d4449de25da2")
+	suite.assertPatientIDs("observation-code-value=8480-6$150", "57ec3d291445d4449de25da2")
+	suite.assertPatientIDs("observation-code-value=8480-6$140")
+	suite.assertPatientIDs("observation-code-value=8480-6$ge141|http://unitsofmeasure.org|mm[Hg]", "57ec3d291445d4449de25da2", "57ef3d291445d4449de25da2")
+	suite.assertPatientIDs("observation-code-value=8480-6$ge141|http://unitsofmeasure.org|kg")
+	suite.assertPatientIDs("observation-code-value=8480-6$lt130,29463-7$gt80", "57ed3d291445d4449de25da2", "57eg3d291445d4449de25da2")
+
+	// The code and value must match the same component
+	suite.assertPatientIDs("observation-code-value=8462-4$gt140")
+
+	suite.assertPatientIDs("observation-code-value:not=8480-6$gt140", "57ed3d291445d4449de25da2", "57eg3d291445d4449de25da2")
+}
+
+// insertPatients inserts a bare patient for each of the test patient IDs.
+func (suite *PatientParamsSuite) insertPatients() {
+	for _, id := range []string{"57ec3d291445d4449de25da2", "57ed3d291445d4449de25da2", "57ef3d291445d4449de25da2", "57eg3d291445d4449de25da2"} {
+		suite.Require().NoError(server.Database.C("patients").Insert(bson.M{"_id": id, "resourceType": "Patient"}))
+	}
+}
+
+// insertCoded inserts a resource referencing the patient, with a single coding in the code field.
+func (suite *PatientParamsSuite) insertCoded(collection, patientField, codeField, patientID, system, code string) {
+	suite.Require().NoError(server.Database.C(collection).Insert(bson.M{
+		"_id":        bson.NewObjectId().Hex(),
+		patientField: bson.M{"reference": "Patient/" + patientID, "referenceid": patientID, "type": "Patient"},
+		codeField: bson.M{
+			"coding": []bson.M{{"system": system, "code": code, "display": "Test " + collection[:len(collection)-1]}},
+		},
+	}))
+}
+
+func (suite *PatientParamsSuite) assertPatientIDs(query string, ids ...string) {
+	var results []struct {
+		ID string `bson:"_id"`
+	}
+	q := search.Query{Resource: "Patient", Query: query}
+	suite.Require().NoError(search.NewMongoSearcher(server.Database).CreatePipeline(q).All(&results))
+
+	obtained := make([]string, len(results))
+	for i := range results {
+		obtained[i] = results[i].ID
+	}
+	sort.Strings(obtained)
+	if ids == nil {
+		ids = []string{}
+	}
+	suite.Assert().Equal(ids, obtained, query)
+}
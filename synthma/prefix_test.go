@@ -0,0 +1,95 @@
+package synthma
+
+import (
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestPrefixSuite(t *testing.T) {
+	suite.Run(t, new(PrefixSuite))
+}
+
+type PrefixSuite struct {
+	testutil.MongoSuite
+}
+
+func (suite *PrefixSuite) SetupTest() {
+	server.Database = suite.DB()
+
+	var observations []interface{}
+	for _, value := range []float64{90, 99.6, 100, 120, 140, 145} {
+		value := value
+		observations = append(observations, &models.Observation{
+			ValueQuantity: &models.Quantity{Value: &value, Unit: "mmHg", System: "http://unitsofmeasure.org", Code: "mm[Hg]"},
+		})
+	}
+	suite.Require().NoError(server.Database.C("observations").Insert(observations...))
+
+	doses := []uint32{1, 2, 3}
+	var recommendations []interface{}
+	for i := range doses {
+		recommendations = append(recommendations, &models.ImmunizationRecommendation{
+			Recommendation: []models.ImmunizationRecommendationRecommendationComponent{{DoseNumber: &doses[i]}},
+		})
+	}
+	suite.Require().NoError(server.Database.C("immunizationrecommendations").Insert(recommendations...))
+}
+
+func (suite *PrefixSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *PrefixSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *PrefixSuite) TestQuantityPrefixes() {
+	// 100 means [99.5, 100.5), but the other comparisons are exact
+	suite.assertCount("Observation", "value-quantity=100", 2)
+	suite.assertCount("Observation", "value-quantity=eq100", 2)
+	suite.assertCount("Observation", "value-quantity=ne100", 4)
+	suite.assertCount("Observation", "value-quantity=gt140", 1)
+	suite.assertCount("Observation", "value-quantity=ge140", 2)
+	suite.assertCount("Observation", "value-quantity=lt100", 2)
+	suite.assertCount("Observation", "value-quantity=le100", 3)
+	suite.assertCount("Observation", "value-quantity=sa99", 5)
+	suite.assertCount("Observation", "value-quantity=eb100", 1)
+	// Within 10%
+	suite.assertCount("Observation", "value-quantity=ap100", 3)
+	suite.assertCount("Observation", "value-quantity=ap130", 2)
+
+	// Units are optional, but must match when given
+	suite.assertCount("Observation", "value-quantity=gt100|http://unitsofmeasure.org|mm[Hg]", 3)
+	suite.assertCount("Observation", "value-quantity=gt100||mmHg", 3)
+	suite.assertCount("Observation", "value-quantity=gt100||kg", 0)
+}
+
+func (suite *PrefixSuite) TestNumberPrefixes() {
+	// Recommendations are an array, so the comparison applies to any of them
+	suite.assertCount("ImmunizationRecommendation", "dose-number=2", 1)
+	suite.assertCount("ImmunizationRecommendation", "dose-number=ne2", 2)
+	suite.assertCount("ImmunizationRecommendation", "dose-number=gt1", 2)
+	suite.assertCount("ImmunizationRecommendation", "dose-number=le2", 2)
+	suite.assertCount("ImmunizationRecommendation", "dose-number=sa1", 2)
+	suite.assertCount("ImmunizationRecommendation", "dose-number=eb3", 2)
+	suite.assertCount("ImmunizationRecommendation", "dose-number=ap2", 1)
+}
+
+func (suite *PrefixSuite) TestInvalidNumber() {
+	q := search.Query{Resource: "ImmunizationRecommendation", Query: "dose-number=gtmany"}
+	suite.Assert().Panics(func() {
+		search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q)
+	})
+}
+
+func (suite *PrefixSuite) assertCount(resource, query string, expected int) {
+	q := search.Query{Resource: resource, Query: query}
+	count, err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Count()
+	suite.Require().NoError(err)
+	suite.Assert().Equal(expected, count, query)
+}
@@ -0,0 +1,377 @@
+package synthma
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestSearchParametersSuite(t *testing.T) {
+	suite.Run(t, new(SearchParametersSuite))
+}
+
+func TestSearchParamInfoSuite(t *testing.T) {
+	suite.Run(t, new(SearchParamInfoSuite))
+}
+
+// SearchParamInfoSuite tests converting and registering SearchParameter resources, which doesn't need a database
+type SearchParamInfoSuite struct {
+	suite.Suite
+}
+
+func (suite *SearchParamInfoSuite) TestSearchParamInfoForResource() {
+	tests := []struct {
+		name     string
+		sp       models.SearchParameter
+		expected search.SearchParamInfo
+	}{{
+		name: "string",
+		sp:   models.SearchParameter{Code: "address-district", Base: "Patient", Type: "string", Expression: "Patient.address.district"},
+		expected: search.SearchParamInfo{Resource: "Patient", Name: "address-district", Type: "string",
+			Paths: []search.SearchParamPath{{Path: "[]address.district", Type: "string"}}},
+	}, {
+		// Choice elements include each type the parameter can search, unless narrowed with as()
+		name: "choice",
+		sp:   models.SearchParameter{Code: "effective", Base: "Observation", Type: "date", Expression: "Observation.effective"},
+		expected: search.SearchParamInfo{Resource: "Observation", Name: "effective", Type: "date",
+			Paths: []search.SearchParamPath{{Path: "effectiveDateTime", Type: "dateTime"}, {Path: "effectivePeriod", Type: "Period"}}},
+	}, {
+		name: "union with as",
+		sp: models.SearchParameter{Code: "any-value-quantity", Base: "Observation", Type: "quantity",
+			Expression: "Observation.value.as(Quantity) | (Observation.component.value as Quantity)"},
+		expected: search.SearchParamInfo{Resource: "Observation", Name: "any-value-quantity", Type: "quantity",
+			Paths: []search.SearchParamPath{{Path: "valueQuantity", Type: "Quantity"}, {Path: "[]component.valueQuantity", Type: "Quantity"}}},
+	}, {
+		// Primitive types narrowed with as() are capitalized, as in the choice element's name
+		name: "primitive as",
+		sp: models.SearchParameter{Code: "probability", Base: "RiskAssessment", Type: "number",
+			Expression: "RiskAssessment.prediction.probability.as(decimal)"},
+		expected: search.SearchParamInfo{Resource: "RiskAssessment", Name: "probability", Type: "number",
+			Paths: []search.SearchParamPath{{Path: "[]prediction.probabilityDecimal", Type: "decimal"}}},
+	}, {
+		// The XPath is used when there is no expression
+		name: "xpath",
+		sp: models.SearchParameter{Code: "any-code", Base: "Observation", Type: "token",
+			Xpath: "f:Observation/f:code | f:Observation/f:component/f:code"},
+		expected: search.SearchParamInfo{Resource: "Observation", Name: "any-code", Type: "token",
+			Paths: []search.SearchParamPath{{Path: "code", Type: "CodeableConcept"}, {Path: "[]component.code", Type: "CodeableConcept"}}},
+	}, {
+		// References target any resource unless targets are given
+		name: "reference",
+		sp:   models.SearchParameter{Code: "performer-any", Base: "Observation", Type: "reference", Expression: "Observation.performer"},
+		expected: search.SearchParamInfo{Resource: "Observation", Name: "performer-any", Type: "reference",
+			Paths: []search.SearchParamPath{{Path: "[]performer", Type: "Reference"}}, Targets: []string{"Any"}},
+	}, {
+		name: "reference with targets",
+		sp: models.SearchParameter{Code: "performer-practitioner", Base: "Observation", Type: "reference",
+			Expression: "Observation.performer", Target: []string{"Practitioner"}},
+		expected: search.SearchParamInfo{Resource: "Observation", Name: "performer-practitioner", Type: "reference",
+			Paths: []search.SearchParamPath{{Path: "[]performer", Type: "Reference"}}, Targets: []string{"Practitioner"}},
+	}}
+
+	for _, test := range tests {
+		info, err := search.SearchParamInfoForResource(&test.sp)
+		if suite.NoError(err, test.name) {
+			suite.Equal(test.expected, info, test.name)
+		}
+	}
+}
+
+func (suite *SearchParamInfoSuite) TestSearchParamInfoForInvalidResource() {
+	tests := []struct {
+		name string
+		sp   models.SearchParameter
+	}{
+		{"no code", models.SearchParameter{Base: "Observation", Type: "token", Expression: "Observation.code"}},
+		{"unknown base", models.SearchParameter{Code: "code", Base: "Nothing", Type: "token", Expression: "Nothing.code"}},
+		{"composite", models.SearchParameter{Code: "code", Base: "Observation", Type: "composite", Expression: "Observation.code"}},
+		{"no expression", models.SearchParameter{Code: "code", Base: "Observation", Type: "token"}},
+		{"other base", models.SearchParameter{Code: "code", Base: "Observation", Type: "token", Expression: "Condition.code"}},
+		{"function", models.SearchParameter{Code: "code", Base: "Observation", Type: "token", Expression: "Observation.code.where(system='x')"}},
+		{"unknown element", models.SearchParameter{Code: "code", Base: "Observation", Type: "token", Expression: "Observation.nothing"}},
+		{"wrong type", models.SearchParameter{Code: "code", Base: "Observation", Type: "token", Expression: "Observation.effective"}},
+	}
+
+	for _, test := range tests {
+		_, err := search.SearchParamInfoForResource(&test.sp)
+		suite.Error(err, test.name)
+	}
+}
+
+type SearchParametersSuite struct {
+	testutil.MongoSuite
+}
+
+func (suite *SearchParametersSuite) SetupTest() {
+	server.Database = suite.DB()
+}
+
+func (suite *SearchParametersSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *SearchParametersSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *SearchParamInfoSuite) TestCheckSearchParameter() {
+	tests := []struct {
+		name      string
+		sp        models.SearchParameter
+		duplicate bool
+	}{
+		{"built in", models.SearchParameter{Code: "name", Base: "Patient", Type: "string", Expression: "Patient.name"}, true},
+		{"registered in code", models.SearchParameter{Code: "condition-code", Base: "Patient", Type: "token", Expression: "Patient.identifier"}, true},
+		{"other base", models.SearchParameter{Code: "condition-code", Base: "Observation", Type: "token", Expression: "Observation.code"}, false},
+		{"new", models.SearchParameter{Code: "check-test", Base: "Patient", Type: "string", Expression: "Patient.address.district"}, false},
+	}
+
+	for _, test := range tests {
+		err := server.CheckSearchParameter(&test.sp)
+		if !test.duplicate {
+			suite.NoError(err, test.name)
+			continue
+		}
+		if suite.IsType(&search.Error{}, err, test.name) {
+			suite.Equal(http.StatusUnprocessableEntity, err.(*search.Error).HTTPStatus, test.name)
+		}
+	}
+}
+
+func (suite *SearchParamInfoSuite) TestRegisterSearchParameter() {
+	require := suite.Require()
+
+	sp := &models.SearchParameter{
+		Url:        "http://example.com/SearchParameter/register-test",
+		Code:       "register-test",
+		Base:       "Patient",
+		Type:       "string",
+		Expression: "Patient.address.district",
+	}
+	_, err := server.RegisterSearchParameter(sp)
+	require.NoError(err)
+
+	// The same SearchParameter may redefine it, but another may not
+	sp.Expression = "Patient.address.city"
+	_, err = server.RegisterSearchParameter(sp)
+	suite.NoError(err)
+	_, err = server.RegisterSearchParameter(&models.SearchParameter{
+		Url:        "http://example.com/SearchParameter/other",
+		Code:       "register-test",
+		Base:       "Patient",
+		Type:       "string",
+		Expression: "Patient.address.state",
+	})
+	suite.Error(err)
+	info, err := search.GlobalRegistry().LookupParameterInfo("Patient", "register-test")
+	require.NoError(err)
+	suite.Equal("[]address.city", info.Paths[0].Path)
+
+	// Built in parameters may not be replaced
+	_, err = server.RegisterSearchParameter(&models.SearchParameter{Code: "gender", Base: "Patient", Type: "token", Expression: "Patient.active"})
+	suite.Error(err)
+	suite.Equal("gender", search.SearchParameters()["Patient"]["gender"].Paths[0].Path)
+}
+
+// TestRegisterWhileSearching registers parameters while queries are built from the dictionary; run with -race
+func (suite *SearchParamInfoSuite) TestRegisterWhileSearching() {
+	stop := make(chan struct{})
+	var started, wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			searcher := search.NewMongoSearcher(nil)
+			started.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				searcher.CreateQueryObject(search.Query{Resource: "Patient", Query: "gender=male&name=Smith"})
+				for range search.SearchParameters()["Patient"] {
+				}
+			}
+		}()
+	}
+
+	started.Wait()
+	for i := 0; i < 50; i++ {
+		_, err := server.RegisterSearchParameter(&models.SearchParameter{
+			Code:       fmt.Sprintf("race-test-%d", i),
+			Base:       "Patient",
+			Type:       "string",
+			Expression: "Patient.address.district",
+		})
+		suite.NoError(err)
+	}
+	close(stop)
+	wg.Wait()
+	suite.Contains(search.SearchParameters()["Patient"], "race-test-49")
+}
+
+func (suite *SearchParametersSuite) TestSearchParamIndexes() {
+	indexMap := server.SearchParamIndexes(search.SearchParamInfo{
+		Resource: "Observation",
+		Paths: []search.SearchParamPath{
+			{Path: "[]performer", Type: "Reference"},
+			{Path: "[]component.code", Type: "CodeableConcept"},
+			{Path: "effectiveDateTime", Type: "dateTime"},
+			{Path: "[]category", Type: "HumanName"},
+		},
+	})
+	suite.Assert().Equal(server.IndexMap{
+		"observations": {
+			{Key: []string{"performer.referenceid", "performer.type"}, Background: true},
+			{Key: []string{"component.code.coding.code", "component.code.coding.system"}, Background: true},
+			{Key: []string{"effectiveDateTime.time"}, Background: true},
+		},
+	}, indexMap)
+}
+
+func (suite *SearchParametersSuite) TestLoadSearchParameters() {
+	require := suite.Require()
+
+	require.NoError(server.Database.C("searchparameters").Insert(&models.SearchParameter{
+		Status:     "active",
+		Code:       "general-practitioner-test",
+		Base:       "Patient",
+		Type:       "reference",
+		Expression: "Patient.generalPractitioner",
+		Target:     []string{"Practitioner"},
+	}))
+	require.NoError(server.Database.C("patients").Insert(
+		&models.Patient{
+			Address:             []models.Address{{District: "Middlesex", State: "MA"}},
+			GeneralPractitioner: []models.Reference{{Reference: "Practitioner/1", ReferencedID: "1", Type: "Practitioner"}},
+		},
+		&models.Patient{Address: []models.Address{{District: "Suffolk", State: "MA"}}},
+	))
+	low, high := 0.3, 0.7
+	require.NoError(server.Database.C("riskassessments").Insert(
+		&models.RiskAssessment{Prediction: []models.RiskAssessmentPredictionComponent{{ProbabilityDecimal: &low}}},
+		&models.RiskAssessment{Prediction: []models.RiskAssessmentPredictionComponent{{ProbabilityDecimal: &high}}},
+	))
+
+	config := server.DefaultConfig
+	config.SearchParameterPath = "../config/searchparameters"
+	ms := server.NewMasterSession(server.Database.Session, server.Database.Name)
+	registered := server.LoadSearchParameters(ms, config)
+	suite.Len(registered, 3)
+	server.BackfillSearchParameters(ms, registered)
+
+	suite.assertCount("Patient", "address-district=Middlesex", 1)
+	suite.assertCount("Patient", "address-district=Suffolk", 1)
+	suite.assertCount("Patient", "general-practitioner-test=Practitioner/1", 1)
+	suite.assertCount("RiskAssessment", "probability=ge0.5", 1)
+	suite.assertCount("RiskAssessment", "probability=lt0.5", 1)
+}
+
+func (suite *SearchParametersSuite) TestSearchParameterInterceptor() {
+	require := suite.Require()
+
+	require.NoError(server.Database.C("observations").Insert(&models.Observation{
+		Component: []models.ObservationComponentComponent{{Code: &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "8480-6"}}}}},
+	}))
+
+	interceptor := server.NewSearchParameterInterceptor(server.NewMasterSession(server.Database.Session, server.Database.Name), server.DefaultConfig)
+	interceptor.After(&models.SearchParameter{
+		Status:     "active",
+		Code:       "component-code-test",
+		Base:       "Observation",
+		Type:       "token",
+		Expression: "Observation.component.code",
+	})
+
+	suite.assertCount("Observation", "component-code-test=http://loinc.org|8480-6", 1)
+}
+
+func (suite *SearchParametersSuite) TestCreateDuplicateSearchParameter() {
+	_, handler := newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+	for _, op := range []struct{ method, path string }{{"POST", "/SearchParameter"}, {"PUT", "/SearchParameter/57ec3d291445d4449de25da2"}} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(op.method, "http://example.com"+op.path, strings.NewReader(`{
+			"resourceType": "SearchParameter",
+			"status": "active",
+			"code": "birthdate",
+			"base": "Patient",
+			"type": "date",
+			"expression": "Patient.deceasedDateTime"
+		}`))
+		r.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(w, r)
+		suite.Equal(http.StatusUnprocessableEntity, w.Code, op.method)
+	}
+
+	n, err := server.Database.C("searchparameters").Count()
+	suite.Require().NoError(err)
+	suite.Equal(0, n)
+	suite.Equal("birthDate", search.SearchParameters()["Patient"]["birthdate"].Paths[0].Path)
+}
+
+// TestCreateWhileSearching creates SearchParameters while searches are running; run with -race
+func (suite *SearchParametersSuite) TestCreateWhileSearching() {
+	ms := server.NewMasterSession(suite.DB().Session, suite.DB().Name)
+	interceptors := map[string]server.InterceptorList{
+		"Create": {{ResourceType: "SearchParameter", Handler: server.NewSearchParameterInterceptor(ms, server.DefaultConfig)}},
+	}
+	_, handler := newTestServer(&suite.MongoSuite, interceptors, server.DefaultConfig)
+
+	stop := make(chan struct{})
+	var started, wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/Patient?gender=male&name=Smith", nil))
+				suite.Equal(http.StatusOK, w.Code)
+			}
+		}()
+	}
+
+	started.Wait()
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "http://example.com/SearchParameter", strings.NewReader(fmt.Sprintf(`{
+			"resourceType": "SearchParameter",
+			"status": "active",
+			"code": "create-race-test-%d",
+			"base": "Patient",
+			"type": "string",
+			"expression": "Patient.address.district"
+		}`, i)))
+		r.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(w, r)
+		suite.Equal(http.StatusCreated, w.Code)
+	}
+	close(stop)
+	wg.Wait()
+	suite.assertCount("Patient", "create-race-test-9=Middlesex", 0)
+}
+
+func (suite *SearchParametersSuite) assertCount(resource, query string, expected int) {
+	q := search.Query{Resource: resource, Query: query}
+	count, err := search.NewMongoSearcher(server.Database).CreateQueryWithoutOptions(q).Count()
+	suite.Require().NoError(err)
+	suite.Assert().Equal(expected, count, query)
+}
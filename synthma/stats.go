@@ -0,0 +1,163 @@
+package synthma
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// StatisticsStore persists the facts needed to compute the patient statistics used by the Synthetic
+// Mass UI.  Implementations are expected to keep their aggregate statistics (population, condition
+// prevalence, etc.) up to date as facts are saved and deleted.  Saving a fact with an ID that was
+// previously saved replaces the earlier fact.
+type StatisticsStore interface {
+	SavePatient(fact PatientFact) error
+	DeletePatient(id string) error
+	SaveCondition(fact ConditionFact) error
+	DeleteCondition(id string) error
+	SaveEncounter(fact EncounterFact) error
+	DeleteEncounter(id string) error
+}
+
+// PatientFact is the subset of a Patient resource tracked for statistics.  The geographic fields
+// come from the patient's home address (or first address, if none is marked as home).  County is
+// taken from the address's district.  The age band is computed from the birth date (and date of
+// death) when the fact is created, so it must be refreshed as time passes.
+type PatientFact struct {
+	ID         string
+	Gender     string
+	AgeBand    string
+	Deceased   bool
+	BirthDate  *time.Time
+	DeathDate  *time.Time
+	State      string
+	County     string
+	City       string
+	PostalCode string
+}
+
+// ConditionFact is the subset of a Condition resource tracked for statistics.  A Condition
+// contributes to the prevalence of every code in its code.coding list.
+type ConditionFact struct {
+	ID        string
+	PatientID string
+	Codes     []models.Coding
+}
+
+// EncounterFact is the subset of an Encounter resource tracked for statistics.
+type EncounterFact struct {
+	ID        string
+	PatientID string
+	Class     string
+}
+
+// UnknownAgeBand is the age band used for patients without a birth date.
+const UnknownAgeBand = "unknown"
+
+// NewPatientFact extracts the statistics-relevant data from a Patient.  The age band is computed
+// relative to the passed in time.
+func NewPatientFact(patient *models.Patient, now time.Time) PatientFact {
+	fact := PatientFact{
+		ID:      patient.Id,
+		Gender:  patient.Gender,
+		AgeBand: UnknownAgeBand,
+	}
+
+	if patient.DeceasedBoolean != nil {
+		fact.Deceased = *patient.DeceasedBoolean
+	}
+	if patient.DeceasedDateTime != nil {
+		fact.Deceased = true
+		fact.DeathDate = &patient.DeceasedDateTime.Time
+	}
+
+	if address := homeAddress(patient.Address); address != nil {
+		fact.State = address.State
+		fact.County = address.District
+		fact.City = address.City
+		fact.PostalCode = address.PostalCode
+	}
+
+	if patient.BirthDate != nil {
+		fact.BirthDate = &patient.BirthDate.Time
+	}
+	fact.AgeBand = fact.CurrentAgeBand(now)
+
+	return fact
+}
+
+// CurrentAgeBand returns the patient's age band as of the passed in time.  Deceased patients are
+// aged as of their date of death.
+func (f PatientFact) CurrentAgeBand(now time.Time) string {
+	if f.BirthDate == nil {
+		return UnknownAgeBand
+	}
+	asOf := now
+	if f.DeathDate != nil && f.DeathDate.Before(now) {
+		asOf = *f.DeathDate
+	}
+	return AgeBand(*f.BirthDate, asOf)
+}
+
+// NewConditionFact extracts the statistics-relevant data from a Condition.
+func NewConditionFact(condition *models.Condition) ConditionFact {
+	fact := ConditionFact{
+		ID:        condition.Id,
+		PatientID: patientID(condition.Subject),
+	}
+	if condition.Code != nil {
+		fact.Codes = condition.Code.Coding
+	}
+	return fact
+}
+
+// NewEncounterFact extracts the statistics-relevant data from an Encounter.
+func NewEncounterFact(encounter *models.Encounter) EncounterFact {
+	fact := EncounterFact{
+		ID:        encounter.Id,
+		PatientID: patientID(encounter.Patient),
+	}
+	if encounter.Class != nil {
+		fact.Class = encounter.Class.Code
+	}
+	return fact
+}
+
+// AgeBand returns the ten-year age band (e.g., "30-39") for someone born on birthDate, as of the
+// passed in time.  Everyone 90 and older falls into the "90+" band.
+func AgeBand(birthDate, asOf time.Time) string {
+	age := asOf.Year() - birthDate.Year()
+	if asOf.Month() < birthDate.Month() || (asOf.Month() == birthDate.Month() && asOf.Day() < birthDate.Day()) {
+		age--
+	}
+
+	switch {
+	case age < 0:
+		return UnknownAgeBand
+	case age >= 90:
+		return "90+"
+	default:
+		low := age - age%10
+		return fmt.Sprintf("%d-%d", low, low+9)
+	}
+}
+
+func homeAddress(addresses []models.Address) *models.Address {
+	for i := range addresses {
+		if addresses[i].Use == "home" {
+			return &addresses[i]
+		}
+	}
+	if len(addresses) > 0 {
+		return &addresses[0]
+	}
+	return nil
+}
+
+func patientID(ref *models.Reference) string {
+	if ref == nil || ref.Type != "Patient" {
+		return ""
+	}
+	return ref.ReferencedID
+}
@@ -0,0 +1,71 @@
+package synthma
+
+import (
+	"log"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+)
+
+// StatisticsResourceTypes are the resource types whose changes are tracked in the StatisticsStore.
+var StatisticsResourceTypes = []string{"Patient", "Condition", "Encounter"}
+
+// RegisterStatisticsInterceptors registers Create, Update, and Delete interceptors for each of the
+// StatisticsResourceTypes, keeping the passed in StatisticsStore in sync with the FHIR database.
+func RegisterStatisticsInterceptors(s *server.FHIRServer, store StatisticsStore) error {
+	for _, op := range []string{"Create", "Update", "Delete"} {
+		handler := &StatisticsInterceptor{Store: store, Op: op}
+		for _, resourceType := range StatisticsResourceTypes {
+			if err := s.AddInterceptor(op, resourceType, handler); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StatisticsInterceptor is a server.InterceptorHandler that updates a StatisticsStore after a
+// database operation succeeds.  Op is the database operation the interceptor is registered for.
+type StatisticsInterceptor struct {
+	Store StatisticsStore
+	Op    string
+}
+
+// Before is a no-op.  Since facts are keyed by resource ID, the store can determine the previous
+// state of the resource on its own.
+func (s *StatisticsInterceptor) Before(resource interface{}) {}
+
+// After saves (for Create and Update) or deletes (for Delete) the fact corresponding to the resource.
+func (s *StatisticsInterceptor) After(resource interface{}) {
+	var err error
+	remove := s.Op == "Delete"
+
+	switch r := resource.(type) {
+	case *models.Patient:
+		if remove {
+			err = s.Store.DeletePatient(r.Id)
+		} else {
+			err = s.Store.SavePatient(NewPatientFact(r, time.Now()))
+		}
+	case *models.Condition:
+		if remove {
+			err = s.Store.DeleteCondition(r.Id)
+		} else {
+			err = s.Store.SaveCondition(NewConditionFact(r))
+		}
+	case *models.Encounter:
+		if remove {
+			err = s.Store.DeleteEncounter(r.Id)
+		} else {
+			err = s.Store.SaveEncounter(NewEncounterFact(r))
+		}
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Could not update statistics after %s: %s\n", s.Op, err.Error())
+	}
+}
+
+// OnError is a no-op.  Statistics are only updated when the database operation succeeds.
+func (s *StatisticsInterceptor) OnError(err error, resource interface{}) {}
@@ -0,0 +1,707 @@
+package synthma
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStatisticsStore is a StatisticsStore backed by a Postgres database.  Facts are stored in
+// the patients, conditions, and encounters tables, and the following aggregate tables are kept up
+// to date as the facts change:
+//
+//	population_stats:         living and deceased patients by gender and age band
+//	condition_prevalence:     number of distinct patients having each condition code
+//	encounter_stats:          number of encounters (and distinct patients) by encounter class
+//	geo_population:           living and deceased patients by region, gender, and age band
+//	geo_condition_prevalence: number of distinct patients in each region having each condition code
+//
+// The aggregates are adjusted by the difference between each fact's old and new values, rather
+// than recomputed, so each change costs the same regardless of the population's size.  Whether a
+// patient is counted as having a condition code or encounter class is tracked by the number of the
+// patient's conditions with the code (in patient_condition_codes) and encounters of the class (in
+// patient_encounter_classes).  Since age bands change as time passes, RefreshAgeBands should be run
+// periodically.
+//
+// Changes to the same resources are applied one at a time (see lockKeys), and the shared aggregate
+// rows are updated in a consistent order so concurrent changes rarely deadlock.  Transactions that
+// Postgres aborts as deadlocked or unserializable anyway are retried.
+//
+// Postgres 9.6 or later is required.
+type PostgresStatisticsStore struct {
+	DB *sql.DB
+}
+
+// NewPostgresStatisticsStore connects to the Postgres database at the given URL and ensures that the
+// statistics schema exists.
+func NewPostgresStatisticsStore(pgURL string) (*PostgresStatisticsStore, error) {
+	db, err := sql.Open("postgres", pgURL)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &PostgresStatisticsStore{DB: db}
+	if err = store.EnsureSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+var statisticsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS patients (
+		id text PRIMARY KEY,
+		gender text NOT NULL,
+		age_band text NOT NULL,
+		deceased boolean NOT NULL,
+		state text NOT NULL DEFAULT '',
+		county text NOT NULL DEFAULT '',
+		city text NOT NULL DEFAULT '',
+		postal_code text NOT NULL DEFAULT ''
+	)`,
+	// The address columns were added after the patients table was first introduced
+	`ALTER TABLE patients ADD COLUMN IF NOT EXISTS state text NOT NULL DEFAULT ''`,
+	`ALTER TABLE patients ADD COLUMN IF NOT EXISTS county text NOT NULL DEFAULT ''`,
+	`ALTER TABLE patients ADD COLUMN IF NOT EXISTS city text NOT NULL DEFAULT ''`,
+	`ALTER TABLE patients ADD COLUMN IF NOT EXISTS postal_code text NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS patients_state_idx ON patients (state)`,
+	// The birth and death dates were added to refresh age bands; patients saved earlier aren't refreshed until saved again
+	`ALTER TABLE patients ADD COLUMN IF NOT EXISTS birth_date date`,
+	`ALTER TABLE patients ADD COLUMN IF NOT EXISTS death_date date`,
+	`CREATE TABLE IF NOT EXISTS conditions (
+		id text NOT NULL,
+		patient_id text NOT NULL,
+		system text NOT NULL,
+		code text NOT NULL,
+		display text NOT NULL,
+		PRIMARY KEY (id, system, code)
+	)`,
+	`CREATE INDEX IF NOT EXISTS conditions_system_code_idx ON conditions (system, code)`,
+	`CREATE INDEX IF NOT EXISTS conditions_patient_id_idx ON conditions (patient_id)`,
+	`CREATE TABLE IF NOT EXISTS encounters (
+		id text PRIMARY KEY,
+		patient_id text NOT NULL,
+		class text NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS encounters_class_idx ON encounters (class)`,
+	`CREATE TABLE IF NOT EXISTS patient_condition_codes (
+		patient_id text NOT NULL,
+		system text NOT NULL,
+		code text NOT NULL,
+		conditions integer NOT NULL,
+		PRIMARY KEY (patient_id, system, code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS patient_encounter_classes (
+		patient_id text NOT NULL,
+		class text NOT NULL,
+		encounters integer NOT NULL,
+		PRIMARY KEY (patient_id, class)
+	)`,
+	`CREATE TABLE IF NOT EXISTS population_stats (
+		gender text NOT NULL,
+		age_band text NOT NULL,
+		living integer NOT NULL,
+		deceased integer NOT NULL,
+		PRIMARY KEY (gender, age_band)
+	)`,
+	`CREATE TABLE IF NOT EXISTS condition_prevalence (
+		system text NOT NULL,
+		code text NOT NULL,
+		display text NOT NULL,
+		patients integer NOT NULL,
+		PRIMARY KEY (system, code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS encounter_stats (
+		class text PRIMARY KEY,
+		encounters integer NOT NULL,
+		patients integer NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS geo_population (
+		level text NOT NULL,
+		state text NOT NULL,
+		region text NOT NULL,
+		gender text NOT NULL,
+		age_band text NOT NULL,
+		living integer NOT NULL,
+		deceased integer NOT NULL,
+		PRIMARY KEY (level, state, region, gender, age_band)
+	)`,
+	`CREATE TABLE IF NOT EXISTS geo_condition_prevalence (
+		level text NOT NULL,
+		state text NOT NULL,
+		region text NOT NULL,
+		system text NOT NULL,
+		code text NOT NULL,
+		patients integer NOT NULL,
+		PRIMARY KEY (level, state, region, system, code)
+	)`,
+}
+
+// countsBackfill populates the patient_condition_codes and patient_encounter_classes tables from the
+// facts stored before they were introduced.
+var countsBackfill = []string{
+	`INSERT INTO patient_condition_codes (patient_id, system, code, conditions)
+		SELECT patient_id, system, code, count(DISTINCT id) FROM conditions WHERE patient_id <> ''
+		GROUP BY patient_id, system, code`,
+	`INSERT INTO patient_encounter_classes (patient_id, class, encounters)
+		SELECT patient_id, class, count(*) FROM encounters WHERE patient_id <> '' GROUP BY patient_id, class`,
+}
+
+// EnsureSchema creates the statistics tables and indexes if they do not already exist.
+func (p *PostgresStatisticsStore) EnsureSchema() error {
+	var newCounts bool
+	if err := p.DB.QueryRow(`SELECT to_regclass('patient_condition_codes') IS NULL`).Scan(&newCounts); err != nil {
+		return err
+	}
+	for _, stmt := range statisticsSchema {
+		if _, err := p.DB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if newCounts {
+		for _, stmt := range countsBackfill {
+			if _, err := p.DB.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying database connection pool.
+func (p *PostgresStatisticsStore) Close() error {
+	return p.DB.Close()
+}
+
+// SavePatient implements StatisticsStore.
+func (p *PostgresStatisticsStore) SavePatient(fact PatientFact) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if err := lockKeys(tx, "Patient/"+fact.ID); err != nil {
+			return err
+		}
+		old, err := selectPatient(tx, fact.ID)
+		if err != nil {
+			return err
+		}
+		if err = upsertPatient(tx, fact); err != nil {
+			return err
+		}
+		return adjustPatient(tx, old, &fact)
+	})
+}
+
+// DeletePatient implements StatisticsStore.
+func (p *PostgresStatisticsStore) DeletePatient(id string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if err := lockKeys(tx, "Patient/"+id); err != nil {
+			return err
+		}
+		old, err := selectPatient(tx, id)
+		if err != nil || old == nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM patients WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return adjustPatient(tx, old, nil)
+	})
+}
+
+// RefreshAgeBands moves the patients who have had a birthday into a new age band since they were
+// saved, as of the passed in time, returning the number of patients moved.  Patients are only
+// moved when their birth date is known.
+func (p *PostgresStatisticsStore) RefreshAgeBands(now time.Time) (int, error) {
+	rows, err := p.DB.Query(`SELECT id, age_band, birth_date, death_date FROM patients WHERE birth_date IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	var stale []string
+	for rows.Next() {
+		var fact PatientFact
+		if err = rows.Scan(&fact.ID, &fact.AgeBand, &fact.BirthDate, &fact.DeathDate); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if fact.CurrentAgeBand(now) != fact.AgeBand {
+			stale = append(stale, fact.ID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range stale {
+		// The transaction may be retried, so the patient is only counted once it's committed
+		refreshed := false
+		err = p.inTx(func(tx *sql.Tx) error {
+			refreshed = false
+			if err := lockKeys(tx, "Patient/"+id); err != nil {
+				return err
+			}
+			// The patient may have changed since it was read
+			old, err := selectPatient(tx, id)
+			if err != nil || old == nil || old.CurrentAgeBand(now) == old.AgeBand {
+				return err
+			}
+			fact := *old
+			fact.AgeBand = old.CurrentAgeBand(now)
+			if _, err = tx.Exec(`UPDATE patients SET age_band = $2 WHERE id = $1`, id, fact.AgeBand); err != nil {
+				return err
+			}
+			refreshed = true
+			return adjustPatient(tx, old, &fact)
+		})
+		if err != nil {
+			return moved, err
+		}
+		if refreshed {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// SaveCondition implements StatisticsStore.
+func (p *PostgresStatisticsStore) SaveCondition(fact ConditionFact) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		old, err := lockCondition(tx, fact.ID, fact.PatientID)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM conditions WHERE id = $1`, fact.ID); err != nil {
+			return err
+		}
+		// A code repeated in the condition's codings is only counted once, as it's only stored once
+		var codes []conditionCode
+		seen := make(map[[2]string]bool)
+		for _, coding := range fact.Codes {
+			key := [2]string{coding.System, coding.Code}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			_, err = tx.Exec(`INSERT INTO conditions (id, patient_id, system, code, display) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (id, system, code) DO NOTHING`,
+				fact.ID, fact.PatientID, coding.System, coding.Code, coding.Display)
+			if err != nil {
+				return err
+			}
+			codes = append(codes, conditionCode{fact.PatientID, coding.System, coding.Code, coding.Display})
+		}
+		return adjustConditionCodes(tx, old, codes)
+	})
+}
+
+// DeleteCondition implements StatisticsStore.
+func (p *PostgresStatisticsStore) DeleteCondition(id string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		old, err := lockCondition(tx, id, "")
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM conditions WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return adjustConditionCodes(tx, old, nil)
+	})
+}
+
+// SaveEncounter implements StatisticsStore.
+func (p *PostgresStatisticsStore) SaveEncounter(fact EncounterFact) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if err := lockKeys(tx, "Encounter/"+fact.ID); err != nil {
+			return err
+		}
+		old, err := selectEncounter(tx, fact.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO encounters (id, patient_id, class) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO UPDATE SET patient_id = EXCLUDED.patient_id, class = EXCLUDED.class`,
+			fact.ID, fact.PatientID, fact.Class)
+		if err != nil {
+			return err
+		}
+		// The classes' rows are updated in order, so concurrent changes can't deadlock
+		changes := []encounterChange{{fact, 1}}
+		if old != nil {
+			changes = append(changes, encounterChange{*old, -1})
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].fact.Class < changes[j].fact.Class })
+		for _, change := range changes {
+			if err = adjustEncounterStats(tx, change.fact, change.delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteEncounter implements StatisticsStore.
+func (p *PostgresStatisticsStore) DeleteEncounter(id string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if err := lockKeys(tx, "Encounter/"+id); err != nil {
+			return err
+		}
+		old, err := selectEncounter(tx, id)
+		if err != nil || old == nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM encounters WHERE id = $1`, id); err != nil {
+			return err
+		}
+		return adjustEncounterStats(tx, *old, -1)
+	})
+}
+
+// statisticsLockID namespaces the Postgres advisory locks taken by lockKeys.
+const statisticsLockID = 7261
+
+// maxTxAttempts is the number of times inTx attempts a transaction that is aborted as deadlocked or
+// unserializable.
+const maxTxAttempts = 5
+
+// inTx runs fn in a transaction, committing if fn succeeds and rolling back otherwise.  If Postgres
+// aborts the transaction as deadlocked or unserializable, it's retried, so fn may be called again.
+func (p *PostgresStatisticsStore) inTx(fn func(tx *sql.Tx) error) (err error) {
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		if err = p.attemptTx(fn); !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *PostgresStatisticsStore) attemptTx(fn func(tx *sql.Tx) error) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isRetryable returns whether the error aborted a transaction that may succeed if retried.
+func isRetryable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code.Name() {
+	case "deadlock_detected", "serialization_failure":
+		return true
+	}
+	return false
+}
+
+// lockKeys takes advisory locks, held until the transaction ends, on the resources identified by the
+// keys (e.g., "Patient/123"), so concurrent changes to the same resources are applied one at a time
+// while changes to other resources aren't blocked.  Conditions are always locked before their
+// patients, and the patients in order, so transactions locking several can't deadlock on the advisory
+// locks.  (The aggregate rows the transactions update are locked too, so they are also updated in
+// order.)
+func lockKeys(tx *sql.Tx, keys ...string) error {
+	keys = uniqueStrings(keys)
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, statisticsLockID, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectPatient returns the stored patient fact, or nil if there isn't one.
+func selectPatient(tx *sql.Tx, id string) (*PatientFact, error) {
+	fact := &PatientFact{ID: id}
+	err := tx.QueryRow(`SELECT gender, age_band, deceased, birth_date, death_date, state, county, city, postal_code
+		FROM patients WHERE id = $1`, id).
+		Scan(&fact.Gender, &fact.AgeBand, &fact.Deceased, &fact.BirthDate, &fact.DeathDate, &fact.State, &fact.County,
+			&fact.City, &fact.PostalCode)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return fact, nil
+}
+
+func upsertPatient(tx *sql.Tx, fact PatientFact) error {
+	_, err := tx.Exec(`INSERT INTO patients (id, gender, age_band, deceased, birth_date, death_date, state, county, city, postal_code)
+		VALUES ($1, $2, $3, $4, $5::date, $6::date, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET gender = EXCLUDED.gender, age_band = EXCLUDED.age_band, deceased = EXCLUDED.deceased,
+			birth_date = EXCLUDED.birth_date, death_date = EXCLUDED.death_date,
+			state = EXCLUDED.state, county = EXCLUDED.county, city = EXCLUDED.city, postal_code = EXCLUDED.postal_code`,
+		fact.ID, fact.Gender, fact.AgeBand, fact.Deceased, dateParam(fact.BirthDate), dateParam(fact.DeathDate),
+		fact.State, fact.County, fact.City, fact.PostalCode)
+	return err
+}
+
+// dateParam formats the (possibly missing) date as a date parameter, so it isn't shifted to another
+// day by converting time zones.
+func dateParam(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02")
+}
+
+// adjustPatient moves a patient's counts from its old fact to its new one.  Either may be nil, for a
+// new or deleted patient.  The patient must be locked.
+func adjustPatient(tx *sql.Tx, old, fact *PatientFact) error {
+	type change struct {
+		fact  *PatientFact
+		delta int
+	}
+	var changes []change
+	for _, c := range []change{{old, -1}, {fact, 1}} {
+		if c.fact != nil {
+			changes = append(changes, c)
+		}
+	}
+	// The population rows are updated in order, so concurrent changes can't deadlock
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i].fact, changes[j].fact
+		return a.Gender < b.Gender || (a.Gender == b.Gender && a.AgeBand < b.AgeBand)
+	})
+	for _, c := range changes {
+		if err := adjustPopulation(tx, *c.fact, c.delta); err != nil {
+			return err
+		}
+	}
+	for _, c := range changes {
+		if err := adjustGeoPopulation(tx, *c.fact, c.delta); err != nil {
+			return err
+		}
+	}
+
+	// The patient's conditions only need to move if the patient moved (or is new or deleted)
+	if old != nil && fact != nil && old.State == fact.State && old.County == fact.County && old.City == fact.City &&
+		old.PostalCode == fact.PostalCode {
+		return nil
+	}
+	id := old
+	if id == nil {
+		id = fact
+	}
+	keys, err := selectPatientConditionKeys(tx, id.ID)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if err = adjustGeoConditionPrevalence(tx, old.Regions(), keys, -1); err != nil {
+			return err
+		}
+	}
+	if fact != nil {
+		return adjustGeoConditionPrevalence(tx, fact.Regions(), keys, 1)
+	}
+	return nil
+}
+
+// adjustPopulation adds delta to the count of living or deceased patients in the fact's gender and age band.
+func adjustPopulation(tx *sql.Tx, fact PatientFact, delta int) error {
+	living, deceased := livingAndDeceased(fact, delta)
+	_, err := tx.Exec(`INSERT INTO population_stats (gender, age_band, living, deceased) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (gender, age_band) DO UPDATE SET living = population_stats.living + EXCLUDED.living,
+			deceased = population_stats.deceased + EXCLUDED.deceased`,
+		fact.Gender, fact.AgeBand, living, deceased)
+	return err
+}
+
+func livingAndDeceased(fact PatientFact, delta int) (living, deceased int) {
+	if fact.Deceased {
+		return 0, delta
+	}
+	return delta, 0
+}
+
+// conditionCode is a condition code of one of a patient's conditions.
+type conditionCode struct {
+	PatientID string
+	System    string
+	Code      string
+	Display   string
+}
+
+// lockCondition locks the condition and the patients it belongs to, before and after it's saved, then
+// returns its stored codes.
+func lockCondition(tx *sql.Tx, id, patientID string) ([]conditionCode, error) {
+	if err := lockKeys(tx, "Condition/"+id); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT patient_id, system, code, display FROM conditions WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []conditionCode
+	patients := []string{"Patient/" + patientID}
+	for rows.Next() {
+		var code conditionCode
+		if err = rows.Scan(&code.PatientID, &code.System, &code.Code, &code.Display); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		patients = append(patients, "Patient/"+code.PatientID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return codes, lockKeys(tx, patients...)
+}
+
+// adjustConditionCodes replaces a condition's old codes with its new ones in the counts of the
+// patients having each code.  Conditions that don't belong to a patient aren't counted.  The shared
+// prevalence rows are updated in order of (system, code) once the patients' counts are known, so
+// concurrent changes can't deadlock.
+func adjustConditionCodes(tx *sql.Tx, old, codes []conditionCode) error {
+	type prevalenceChange struct {
+		code  conditionCode
+		delta int
+	}
+	var changes []prevalenceChange
+
+	for _, code := range old {
+		if code.PatientID == "" {
+			continue
+		}
+		var conditions int
+		err := tx.QueryRow(`UPDATE patient_condition_codes SET conditions = conditions - 1
+			WHERE patient_id = $1 AND system = $2 AND code = $3 RETURNING conditions`,
+			code.PatientID, code.System, code.Code).Scan(&conditions)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if conditions > 0 {
+			continue
+		}
+		_, err = tx.Exec(`DELETE FROM patient_condition_codes WHERE patient_id = $1 AND system = $2 AND code = $3`,
+			code.PatientID, code.System, code.Code)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, prevalenceChange{code, -1})
+	}
+
+	for _, code := range codes {
+		if code.PatientID == "" {
+			continue
+		}
+		var conditions int
+		err := tx.QueryRow(`INSERT INTO patient_condition_codes (patient_id, system, code, conditions) VALUES ($1, $2, $3, 1)
+			ON CONFLICT (patient_id, system, code) DO UPDATE SET conditions = patient_condition_codes.conditions + 1
+			RETURNING conditions`,
+			code.PatientID, code.System, code.Code).Scan(&conditions)
+		if err != nil {
+			return err
+		}
+		if conditions == 1 {
+			changes = append(changes, prevalenceChange{code, 1})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		a, b := changes[i].code, changes[j].code
+		return a.System < b.System || (a.System == b.System && a.Code < b.Code)
+	})
+	for _, change := range changes {
+		if err := adjustConditionPrevalence(tx, change.code, change.delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustConditionPrevalence adds delta to the number of patients having the condition code, overall
+// and in each of the patient's regions.
+func adjustConditionPrevalence(tx *sql.Tx, code conditionCode, delta int) error {
+	_, err := tx.Exec(`INSERT INTO condition_prevalence (system, code, display, patients) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (system, code) DO UPDATE SET patients = condition_prevalence.patients + EXCLUDED.patients,
+			display = CASE WHEN EXCLUDED.display = '' THEN condition_prevalence.display ELSE EXCLUDED.display END`,
+		code.System, code.Code, code.Display, delta)
+	if err != nil {
+		return err
+	}
+	patient, err := selectPatient(tx, code.PatientID)
+	if err != nil || patient == nil {
+		return err
+	}
+	return adjustGeoConditionPrevalence(tx, patient.Regions(), [][2]string{{code.System, code.Code}}, delta)
+}
+
+// selectEncounter returns the stored encounter fact, or nil if there isn't one.
+func selectEncounter(tx *sql.Tx, id string) (*EncounterFact, error) {
+	fact := &EncounterFact{ID: id}
+	err := tx.QueryRow(`SELECT patient_id, class FROM encounters WHERE id = $1`, id).Scan(&fact.PatientID, &fact.Class)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return fact, nil
+}
+
+// adjustEncounterStats adds delta to the number of encounters of the encounter's class, and to the
+// number of patients with encounters of the class if the encounter is the patient's first (or last).
+func adjustEncounterStats(tx *sql.Tx, fact EncounterFact, delta int) error {
+	patients := 0
+	if fact.PatientID != "" {
+		var encounters int
+		err := tx.QueryRow(`INSERT INTO patient_encounter_classes (patient_id, class, encounters) VALUES ($1, $2, $3)
+			ON CONFLICT (patient_id, class) DO UPDATE SET encounters = patient_encounter_classes.encounters + EXCLUDED.encounters
+			RETURNING encounters`,
+			fact.PatientID, fact.Class, delta).Scan(&encounters)
+		if err != nil {
+			return err
+		}
+		switch {
+		case delta > 0 && encounters == delta:
+			patients = 1
+		case delta < 0 && encounters <= 0:
+			patients = -1
+			_, err = tx.Exec(`DELETE FROM patient_encounter_classes WHERE patient_id = $1 AND class = $2`, fact.PatientID, fact.Class)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec(`INSERT INTO encounter_stats (class, encounters, patients) VALUES ($1, $2, $3)
+		ON CONFLICT (class) DO UPDATE SET encounters = encounter_stats.encounters + EXCLUDED.encounters,
+			patients = encounter_stats.patients + EXCLUDED.patients`,
+		fact.Class, delta, patients)
+	return err
+}
+
+// encounterChange is a change to the count of encounters of an encounter's class.
+type encounterChange struct {
+	fact  EncounterFact
+	delta int
+}
+
+func uniqueKeys(keys [][2]string) [][2]string {
+	seen := make(map[[2]string]bool)
+	var unique [][2]string
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,264 @@
+package synthma
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// TestPostgresStatisticsSuite runs against the Postgres database at the URL in the PGURL environment
+// variable, and is skipped if it isn't set.  The statistics tables are dropped before each test.
+func TestPostgresStatisticsSuite(t *testing.T) {
+	if os.Getenv("PGURL") == "" {
+		t.Skip("PGURL is not set")
+	}
+	suite.Run(t, new(PostgresStatisticsSuite))
+}
+
+type PostgresStatisticsSuite struct {
+	suite.Suite
+	store *PostgresStatisticsStore
+}
+
+func (suite *PostgresStatisticsSuite) SetupTest() {
+	store, err := NewPostgresStatisticsStore(os.Getenv("PGURL"))
+	suite.Require().NoError(err)
+	_, err = store.DB.Exec(`DROP TABLE IF EXISTS patients, conditions, encounters, patient_condition_codes,
+		patient_encounter_classes, population_stats, condition_prevalence, encounter_stats, geo_population,
+		geo_condition_prevalence`)
+	suite.Require().NoError(err)
+	suite.Require().NoError(store.EnsureSchema())
+	suite.store = store
+}
+
+func (suite *PostgresStatisticsSuite) TearDownTest() {
+	suite.store.Close()
+}
+
+func (suite *PostgresStatisticsSuite) TestPopulation() {
+	require := suite.Require()
+
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "30-39"}))
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "2", Gender: "female", AgeBand: "30-39", Deceased: true}))
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "3", Gender: "male", AgeBand: "30-39"}))
+	suite.assertPopulation("female", "30-39", 1, 1)
+	suite.assertPopulation("male", "30-39", 1, 0)
+
+	// Saving again moves the patient rather than counting it twice
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "40-49"}))
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "40-49"}))
+	suite.assertPopulation("female", "30-39", 0, 1)
+	suite.assertPopulation("female", "40-49", 1, 0)
+
+	require.NoError(suite.store.DeletePatient("2"))
+	require.NoError(suite.store.DeletePatient("2"))
+	suite.assertPopulation("female", "30-39", 0, 0)
+}
+
+func (suite *PostgresStatisticsSuite) TestConditionPrevalence() {
+	require := suite.Require()
+
+	diabetes := models.Coding{System: "http://snomed.info/sct", Code: "44054006", Display: "Diabetes"}
+	asthma := models.Coding{System: "http://snomed.info/sct", Code: "195967001", Display: "Asthma"}
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "30-39", State: "MA", City: "Bedford"}))
+	require.NoError(suite.store.SaveCondition(ConditionFact{ID: "a", PatientID: "1", Codes: []models.Coding{diabetes}}))
+	// A second condition with the same code doesn't count the patient twice
+	require.NoError(suite.store.SaveCondition(ConditionFact{ID: "b", PatientID: "1", Codes: []models.Coding{diabetes}}))
+	require.NoError(suite.store.SaveCondition(ConditionFact{ID: "c", PatientID: "2", Codes: []models.Coding{diabetes}}))
+	suite.assertPrevalence(diabetes, 2)
+	suite.assertGeoPrevalence(StateLevel, "MA", diabetes, 1)
+	suite.assertGeoPrevalence(CityLevel, "Bedford", diabetes, 1)
+
+	require.NoError(suite.store.DeleteCondition("a"))
+	suite.assertPrevalence(diabetes, 2)
+	require.NoError(suite.store.SaveCondition(ConditionFact{ID: "b", PatientID: "1", Codes: []models.Coding{asthma}}))
+	suite.assertPrevalence(diabetes, 1)
+	suite.assertPrevalence(asthma, 1)
+	suite.assertGeoPrevalence(StateLevel, "MA", diabetes, 0)
+	suite.assertGeoPrevalence(StateLevel, "MA", asthma, 1)
+
+	// The patient's conditions move with the patient
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "30-39", State: "RI"}))
+	suite.assertGeoPrevalence(StateLevel, "MA", asthma, 0)
+	suite.assertGeoPrevalence(CityLevel, "Bedford", asthma, 0)
+	suite.assertGeoPrevalence(StateLevel, "RI", asthma, 1)
+
+	require.NoError(suite.store.DeletePatient("1"))
+	suite.assertGeoPrevalence(StateLevel, "RI", asthma, 0)
+	suite.assertPrevalence(asthma, 1)
+}
+
+func (suite *PostgresStatisticsSuite) TestDuplicateConditionCodes() {
+	require := suite.Require()
+
+	// A condition listing the same code twice counts its patient once, and no longer does once deleted
+	diabetes := models.Coding{System: "http://snomed.info/sct", Code: "44054006", Display: "Diabetes"}
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "30-39", State: "MA"}))
+	require.NoError(suite.store.SaveCondition(ConditionFact{ID: "a", PatientID: "1", Codes: []models.Coding{diabetes, diabetes}}))
+	suite.assertPrevalence(diabetes, 1)
+	suite.assertGeoPrevalence(StateLevel, "MA", diabetes, 1)
+
+	require.NoError(suite.store.DeleteCondition("a"))
+	suite.assertPrevalence(diabetes, 0)
+	suite.assertGeoPrevalence(StateLevel, "MA", diabetes, 0)
+	var n int
+	require.NoError(suite.store.DB.QueryRow(`SELECT count(*) FROM patient_condition_codes`).Scan(&n))
+	suite.Equal(0, n)
+}
+
+func (suite *PostgresStatisticsSuite) TestEncounterStats() {
+	require := suite.Require()
+
+	require.NoError(suite.store.SaveEncounter(EncounterFact{ID: "a", PatientID: "1", Class: "outpatient"}))
+	require.NoError(suite.store.SaveEncounter(EncounterFact{ID: "b", PatientID: "1", Class: "outpatient"}))
+	require.NoError(suite.store.SaveEncounter(EncounterFact{ID: "c", PatientID: "2", Class: "outpatient"}))
+	suite.assertEncounters("outpatient", 3, 2)
+
+	require.NoError(suite.store.SaveEncounter(EncounterFact{ID: "c", PatientID: "2", Class: "inpatient"}))
+	suite.assertEncounters("outpatient", 2, 1)
+	suite.assertEncounters("inpatient", 1, 1)
+
+	require.NoError(suite.store.DeleteEncounter("a"))
+	suite.assertEncounters("outpatient", 1, 1)
+	require.NoError(suite.store.DeleteEncounter("b"))
+	suite.assertEncounters("outpatient", 0, 0)
+}
+
+func (suite *PostgresStatisticsSuite) TestGeoPopulation() {
+	require := suite.Require()
+
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "1", Gender: "female", AgeBand: "30-39", State: "MA", City: "Bedford"}))
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "2", Gender: "female", AgeBand: "30-39", State: "MA", City: "Boston"}))
+	stats, err := suite.store.RegionStatistics(RegionQuery{Level: StateLevel})
+	require.NoError(err)
+	require.Len(stats, 1)
+	suite.Equal(2, stats[0].Living)
+
+	require.NoError(suite.store.SavePatient(PatientFact{ID: "2", Gender: "female", AgeBand: "30-39", State: "MA", City: "Bedford"}))
+	stats, err = suite.store.RegionStatistics(RegionQuery{Level: CityLevel, State: "MA"})
+	require.NoError(err)
+	require.Len(stats, 1)
+	suite.Equal("Bedford", stats[0].Region)
+	suite.Equal(2, stats[0].Living)
+
+	require.NoError(suite.store.DeletePatient("1"))
+	require.NoError(suite.store.DeletePatient("2"))
+	stats, err = suite.store.RegionStatistics(RegionQuery{Level: StateLevel})
+	require.NoError(err)
+	suite.Empty(stats)
+}
+
+func (suite *PostgresStatisticsSuite) TestConcurrentSaves() {
+	diabetes := models.Coding{System: "http://snomed.info/sct", Code: "44054006"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := string(rune('a' + i))
+			suite.NoError(suite.store.SavePatient(PatientFact{ID: id, Gender: "male", AgeBand: "20-29", State: "MA"}))
+			suite.NoError(suite.store.SaveCondition(ConditionFact{ID: id, PatientID: id, Codes: []models.Coding{diabetes}}))
+			// Every patient has a second condition saved from both goroutines
+			suite.NoError(suite.store.SaveCondition(ConditionFact{ID: "shared", PatientID: "a", Codes: []models.Coding{diabetes}}))
+		}(i)
+	}
+	wg.Wait()
+
+	suite.assertPopulation("male", "20-29", 20, 0)
+	suite.assertPrevalence(diabetes, 20)
+	suite.assertGeoPrevalence(StateLevel, "MA", diabetes, 20)
+}
+
+func (suite *PostgresStatisticsSuite) TestConcurrentOpposingSaves() {
+	diabetes := models.Coding{System: "http://snomed.info/sct", Code: "44054006"}
+	asthma := models.Coding{System: "http://snomed.info/sct", Code: "195967001"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Alternate patients list the same codes, and move between the same age bands, in opposite orders
+			id := string(rune('a' + i))
+			codes, from, to := []models.Coding{diabetes, asthma}, "20-29", "30-39"
+			if i%2 == 1 {
+				codes, from, to = []models.Coding{asthma, diabetes}, "30-39", "20-29"
+			}
+			suite.NoError(suite.store.SavePatient(PatientFact{ID: id, Gender: "male", AgeBand: from, State: "MA"}))
+			suite.NoError(suite.store.SaveCondition(ConditionFact{ID: id, PatientID: id, Codes: codes}))
+			suite.NoError(suite.store.SavePatient(PatientFact{ID: id, Gender: "male", AgeBand: to, State: "MA"}))
+		}(i)
+	}
+	wg.Wait()
+
+	suite.assertPopulation("male", "20-29", 10, 0)
+	suite.assertPopulation("male", "30-39", 10, 0)
+	suite.assertPrevalence(diabetes, 20)
+	suite.assertPrevalence(asthma, 20)
+	suite.assertGeoPrevalence(StateLevel, "MA", asthma, 20)
+}
+
+func (suite *PostgresStatisticsSuite) TestRefreshAgeBands() {
+	require := suite.Require()
+
+	saved := time.Date(2016, time.October, 1, 0, 0, 0, 0, time.UTC)
+	patient := &models.Patient{
+		Gender:    "female",
+		BirthDate: &models.FHIRDateTime{Time: time.Date(1976, time.October, 2, 0, 0, 0, 0, time.UTC), Precision: models.Date},
+		Address:   []models.Address{{State: "MA"}},
+	}
+	patient.Id = "1"
+	require.NoError(suite.store.SavePatient(NewPatientFact(patient, saved)))
+	suite.assertPopulation("female", "30-39", 1, 0)
+
+	moved, err := suite.store.RefreshAgeBands(saved)
+	require.NoError(err)
+	suite.Equal(0, moved)
+
+	moved, err = suite.store.RefreshAgeBands(saved.AddDate(0, 0, 1))
+	require.NoError(err)
+	suite.Equal(1, moved)
+	suite.assertPopulation("female", "30-39", 0, 0)
+	suite.assertPopulation("female", "40-49", 1, 0)
+	stats, err := suite.store.RegionStatistics(RegionQuery{Level: StateLevel})
+	require.NoError(err)
+	require.Len(stats, 1)
+	suite.Equal(map[string]int{"40-49": 1}, stats[0].AgeBand)
+}
+
+func (suite *PostgresStatisticsSuite) assertPopulation(gender, ageBand string, living, deceased int) {
+	var l, d int
+	err := suite.store.DB.QueryRow(`SELECT coalesce(sum(living), 0), coalesce(sum(deceased), 0) FROM population_stats
+		WHERE gender = $1 AND age_band = $2`, gender, ageBand).Scan(&l, &d)
+	suite.Require().NoError(err)
+	suite.Equal(living, l, "living %s %s", gender, ageBand)
+	suite.Equal(deceased, d, "deceased %s %s", gender, ageBand)
+}
+
+func (suite *PostgresStatisticsSuite) assertPrevalence(coding models.Coding, patients int) {
+	var p int
+	err := suite.store.DB.QueryRow(`SELECT coalesce(sum(patients), 0) FROM condition_prevalence WHERE system = $1 AND code = $2`,
+		coding.System, coding.Code).Scan(&p)
+	suite.Require().NoError(err)
+	suite.Equal(patients, p, "patients with %s", coding.Code)
+}
+
+func (suite *PostgresStatisticsSuite) assertGeoPrevalence(level, region string, coding models.Coding, patients int) {
+	var p int
+	err := suite.store.DB.QueryRow(`SELECT coalesce(sum(patients), 0) FROM geo_condition_prevalence
+		WHERE level = $1 AND region = $2 AND system = $3 AND code = $4`, level, region, coding.System, coding.Code).Scan(&p)
+	suite.Require().NoError(err)
+	suite.Equal(patients, p, "patients in %s with %s", region, coding.Code)
+}
+
+func (suite *PostgresStatisticsSuite) assertEncounters(class string, encounters, patients int) {
+	var e, p int
+	err := suite.store.DB.QueryRow(`SELECT coalesce(sum(encounters), 0), coalesce(sum(patients), 0) FROM encounter_stats
+		WHERE class = $1`, class).Scan(&e, &p)
+	suite.Require().NoError(err)
+	suite.Equal(encounters, e, "%s encounters", class)
+	suite.Equal(patients, p, "%s patients", class)
+}
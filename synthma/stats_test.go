@@ -0,0 +1,184 @@
+package synthma
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestStatisticsSuite(t *testing.T) {
+	suite.Run(t, new(StatisticsSuite))
+}
+
+type StatisticsSuite struct {
+	suite.Suite
+	store *memoryStatisticsStore
+}
+
+func (suite *StatisticsSuite) SetupTest() {
+	suite.store = newMemoryStatisticsStore()
+}
+
+func (suite *StatisticsSuite) TestAgeBand() {
+	assert := suite.Assert()
+
+	now := time.Date(2016, time.October, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal("0-9", AgeBand(time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), now))
+	assert.Equal("30-39", AgeBand(time.Date(1980, time.October, 1, 0, 0, 0, 0, time.UTC), now))
+	// Not quite 40 yet
+	assert.Equal("30-39", AgeBand(time.Date(1976, time.October, 2, 0, 0, 0, 0, time.UTC), now))
+	assert.Equal("90+", AgeBand(time.Date(1910, time.May, 5, 0, 0, 0, 0, time.UTC), now))
+	assert.Equal(UnknownAgeBand, AgeBand(time.Date(2017, time.May, 5, 0, 0, 0, 0, time.UTC), now))
+}
+
+func (suite *StatisticsSuite) TestNewPatientFact() {
+	assert := suite.Assert()
+
+	now := time.Date(2016, time.October, 1, 0, 0, 0, 0, time.UTC)
+	patient := &models.Patient{
+		Gender:           "female",
+		BirthDate:        &models.FHIRDateTime{Time: time.Date(1940, time.March, 3, 0, 0, 0, 0, time.UTC), Precision: models.Date},
+		DeceasedDateTime: &models.FHIRDateTime{Time: time.Date(1995, time.June, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date},
+	}
+	patient.Id = "57ec3d291445d4449de25da2"
+
+	fact := NewPatientFact(patient, now)
+	assert.Equal("57ec3d291445d4449de25da2", fact.ID)
+	assert.Equal("female", fact.Gender)
+	// Aged as of the date of death
+	assert.Equal("50-59", fact.AgeBand)
+	assert.True(fact.Deceased)
+	// The age band doesn't change after death
+	assert.Equal("50-59", fact.CurrentAgeBand(now.AddDate(20, 0, 0)))
+
+	patient.DeceasedDateTime = nil
+	fact = NewPatientFact(patient, now)
+	assert.Equal("70-79", fact.AgeBand)
+	assert.Equal("80-89", fact.CurrentAgeBand(now.AddDate(10, 0, 0)))
+
+	fact = NewPatientFact(&models.Patient{Gender: "male"}, now)
+	assert.Equal(UnknownAgeBand, fact.AgeBand)
+	assert.False(fact.Deceased)
+}
+
+func (suite *StatisticsSuite) TestNewConditionFact() {
+	assert := suite.Assert()
+
+	condition := &models.Condition{
+		Code: &models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "62106007"}},
+		},
+		Subject: &models.Reference{Reference: "Patient/57ec3d291445d4449de25da2", Type: "Patient", ReferencedID: "57ec3d291445d4449de25da2"},
+	}
+	condition.Id = "58ec3d291445d4449de25da2"
+
+	fact := NewConditionFact(condition)
+	assert.Equal("58ec3d291445d4449de25da2", fact.ID)
+	assert.Equal("57ec3d291445d4449de25da2", fact.PatientID)
+	assert.Equal(condition.Code.Coding, fact.Codes)
+
+	// Subjects that aren't patients aren't tracked
+	condition.Subject = &models.Reference{Reference: "Group/1", Type: "Group", ReferencedID: "1"}
+	assert.Equal("", NewConditionFact(condition).PatientID)
+}
+
+func (suite *StatisticsSuite) TestRegisterStatisticsInterceptors() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	s := server.NewServer("localhost")
+	require.NoError(RegisterStatisticsInterceptors(s, suite.store))
+
+	for _, op := range []string{"Create", "Update", "Delete"} {
+		require.Len(s.Interceptors[op], len(StatisticsResourceTypes))
+		for i, interceptor := range s.Interceptors[op] {
+			assert.Equal(StatisticsResourceTypes[i], interceptor.ResourceType)
+			assert.Equal(op, interceptor.Handler.(*StatisticsInterceptor).Op)
+		}
+	}
+}
+
+func (suite *StatisticsSuite) TestInterceptorsMaintainFacts() {
+	assert := suite.Assert()
+
+	create := &StatisticsInterceptor{Store: suite.store, Op: "Create"}
+	update := &StatisticsInterceptor{Store: suite.store, Op: "Update"}
+	del := &StatisticsInterceptor{Store: suite.store, Op: "Delete"}
+
+	patient := &models.Patient{Gender: "male"}
+	patient.Id = "57ec3d291445d4449de25da2"
+	create.After(patient)
+	assert.Equal("male", suite.store.patients[patient.Id].Gender)
+
+	patient.Gender = "female"
+	update.Before(patient)
+	update.After(patient)
+	assert.Len(suite.store.patients, 1)
+	assert.Equal("female", suite.store.patients[patient.Id].Gender)
+
+	encounter := &models.Encounter{Class: &models.Coding{Code: "outpatient"}}
+	encounter.Id = "59ec3d291445d4449de25da2"
+	create.After(encounter)
+	assert.Equal("outpatient", suite.store.encounters[encounter.Id].Class)
+
+	// Failed operations don't touch the store
+	del.OnError(nil, patient)
+	assert.Len(suite.store.patients, 1)
+
+	del.After(patient)
+	del.After(encounter)
+	assert.Empty(suite.store.patients)
+	assert.Empty(suite.store.encounters)
+
+	// Resources that aren't tracked are ignored
+	create.After(&models.Observation{})
+	assert.Empty(suite.store.conditions)
+}
+
+// memoryStatisticsStore is an in-memory stand-in for the Postgres statistics store.
+type memoryStatisticsStore struct {
+	patients   map[string]PatientFact
+	conditions map[string]ConditionFact
+	encounters map[string]EncounterFact
+}
+
+func newMemoryStatisticsStore() *memoryStatisticsStore {
+	return &memoryStatisticsStore{
+		patients:   make(map[string]PatientFact),
+		conditions: make(map[string]ConditionFact),
+		encounters: make(map[string]EncounterFact),
+	}
+}
+
+func (m *memoryStatisticsStore) SavePatient(fact PatientFact) error {
+	m.patients[fact.ID] = fact
+	return nil
+}
+
+func (m *memoryStatisticsStore) DeletePatient(id string) error {
+	delete(m.patients, id)
+	return nil
+}
+
+func (m *memoryStatisticsStore) SaveCondition(fact ConditionFact) error {
+	m.conditions[fact.ID] = fact
+	return nil
+}
+
+func (m *memoryStatisticsStore) DeleteCondition(id string) error {
+	delete(m.conditions, id)
+	return nil
+}
+
+func (m *memoryStatisticsStore) SaveEncounter(fact EncounterFact) error {
+	m.encounters[fact.ID] = fact
+	return nil
+}
+
+func (m *memoryStatisticsStore) DeleteEncounter(id string) error {
+	delete(m.encounters, id)
+	return nil
+}
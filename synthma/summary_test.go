@@ -0,0 +1,137 @@
+package synthma
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestSummarySuite(t *testing.T) {
+	suite.Run(t, new(SummarySuite))
+}
+
+type SummarySuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+	id      string
+}
+
+func (suite *SummarySuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+
+	var err error
+	active := true
+	suite.id, err = suite.dal.Post(&models.Patient{
+		DomainResource: models.DomainResource{Text: &models.Narrative{Status: "generated", Div: "<div>John Doe</div>"}},
+		Active:         &active,
+		Name:           []models.HumanName{{Family: []string{"Doe"}, Given: []string{"John"}}},
+		Gender:         "male",
+		MaritalStatus:  &models.CodeableConcept{Text: "Married"},
+	})
+	suite.Require().NoError(err)
+	_, err = suite.dal.Post(&models.Patient{Gender: "female"})
+	suite.Require().NoError(err)
+}
+
+func (suite *SummarySuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *SummarySuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *SummarySuite) TestCount() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	bundle := suite.search("/Patient?_summary=count")
+	require.NotNil(bundle.Total)
+	assert.Equal(uint32(2), *bundle.Total)
+	assert.Empty(bundle.Entry)
+	require.Len(bundle.Link, 1)
+	assert.Equal("self", bundle.Link[0].Relation)
+}
+
+func (suite *SummarySuite) TestSearchElements() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	bundle := suite.search("/Patient?gender=male&_elements=name")
+	require.Len(bundle.Entry, 1)
+	patient := bundle.Entry[0].Resource.(*models.Patient)
+	assert.Equal(suite.id, patient.Id)
+	assert.Equal([]string{"Doe"}, patient.Name[0].Family)
+	assert.Empty(patient.Gender)
+	assert.Nil(patient.Text)
+	suite.assertSubsetted(patient.Meta)
+
+	bundle = suite.search("/Patient?gender=male&_summary=data")
+	require.Len(bundle.Entry, 1)
+	patient = bundle.Entry[0].Resource.(*models.Patient)
+	assert.Nil(patient.Text)
+	assert.Equal("Married", patient.MaritalStatus.Text)
+	suite.assertSubsetted(patient.Meta)
+
+	// Whole resources aren't tagged
+	bundle = suite.search("/Patient?gender=male&_summary=false")
+	require.Len(bundle.Entry, 1)
+	patient = bundle.Entry[0].Resource.(*models.Patient)
+	assert.NotNil(patient.Text)
+	assert.Empty(patient.Meta.Tag)
+}
+
+func (suite *SummarySuite) TestReadSummary() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	w := suite.get("/Patient/" + suite.id + "?_summary=true")
+	require.Equal(http.StatusOK, w.Code)
+	patient := new(models.Patient)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), patient))
+	assert.Equal("male", patient.Gender)
+	assert.True(*patient.Active)
+	assert.Nil(patient.Text)
+	assert.Nil(patient.MaritalStatus)
+	suite.assertSubsetted(patient.Meta)
+
+	w = suite.get("/Patient/" + suite.id + "?_summary=text")
+	require.Equal(http.StatusOK, w.Code)
+	patient = new(models.Patient)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), patient))
+	assert.Equal("<div>John Doe</div>", patient.Text.Div)
+	assert.Empty(patient.Gender)
+
+	assert.Equal(http.StatusBadRequest, suite.get("/Patient/"+suite.id+"?_summary=bogus").Code)
+	assert.Equal(http.StatusBadRequest, suite.get("/Patient?_summary=true&_elements=name").Code)
+}
+
+func (suite *SummarySuite) assertSubsetted(meta *models.Meta) {
+	suite.Require().NotNil(meta)
+	suite.Require().Len(meta.Tag, 1)
+	suite.Assert().Equal("SUBSETTED", meta.Tag[0].Code)
+	// The rest of the meta is kept
+	suite.Assert().Equal("1", meta.VersionId)
+}
+
+func (suite *SummarySuite) get(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	suite.handler.ServeHTTP(w, r)
+	return w
+}
+
+func (suite *SummarySuite) search(path string) *models.Bundle {
+	w := suite.get(path)
+	suite.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	bundle := new(models.Bundle)
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), bundle))
+	return bundle
+}
@@ -0,0 +1,27 @@
+package synthma
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func init() {
+	gin.SetMode(gin.ReleaseMode)
+	server.ConformanceStatementPath = "../conformance/conformance_statement.json"
+}
+
+// newTestServer points the server package at the suite's test database, and returns a data access layer using it
+// along with a handler serving all of the server's routes, as the server does when it runs.
+func newTestServer(suite *testutil.MongoSuite, interceptors map[string]server.InterceptorList, config server.Config) (server.DataAccessLayer, http.Handler) {
+	server.Database = suite.DB()
+	ms := server.NewMasterSession(server.Database.Session, server.Database.Name)
+	dal := server.NewMongoDataAccessLayer(ms, interceptors, config)
+
+	e := gin.New()
+	e.Use(server.AbortUnsupportedFormats)
+	server.RegisterRoutes(e, nil, dal, config)
+	return dal, server.RegisterOperationRoutes(e, nil, dal, config)
+}
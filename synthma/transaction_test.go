@@ -0,0 +1,271 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestTransactionSuite(t *testing.T) {
+	suite.Run(t, new(TransactionSuite))
+}
+
+type TransactionSuite struct {
+	testutil.MongoSuite
+	interceptor *countingInterceptor
+}
+
+func (suite *TransactionSuite) SetupTest() {
+	suite.interceptor = new(countingInterceptor)
+}
+
+func (suite *TransactionSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *TransactionSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+func (suite *TransactionSuite) TestRollback() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	for _, enableHistory := range []bool{false, true} {
+		dal, _ := suite.newServer(enableHistory)
+		updated, err := dal.Post(&models.Patient{Gender: "male"})
+		require.NoError(err)
+		deleted, err := dal.Post(&models.Patient{Gender: "female"})
+		require.NoError(err)
+		suite.interceptor.after = 0
+
+		failure := errors.New("failure")
+		err = dal.Transaction(func(tx server.DataAccessLayer) error {
+			if _, err := tx.Put(updated, &models.Patient{Gender: "other"}); err != nil {
+				return err
+			}
+			if _, err := tx.Put(updated, &models.Patient{Gender: "unknown"}); err != nil {
+				return err
+			}
+			if _, err := tx.Post(&models.Patient{Gender: "male"}); err != nil {
+				return err
+			}
+			if err := tx.Delete(deleted, "Patient"); err != nil {
+				return err
+			}
+			return failure
+		})
+		assert.Equal(failure, err)
+
+		// Everything is as it was before the transaction
+		result, err := dal.Get(updated, "Patient")
+		require.NoError(err)
+		assert.Equal("male", result.(*models.Patient).Gender)
+		assert.Equal("1", result.(*models.Patient).Meta.VersionId)
+		_, err = dal.Get(deleted, "Patient")
+		assert.NoError(err)
+		suite.assertCount("patients", 2)
+		suite.assertCount("patients_prev", 0)
+
+		// Interceptors are only told about the failures
+		assert.Equal(0, suite.interceptor.after)
+		assert.Equal(4, suite.interceptor.onError)
+
+		require.NoError(suite.DB().C("patients").DropCollection())
+		suite.interceptor.onError = 0
+	}
+}
+
+func (suite *TransactionSuite) TestRollbackOnPanic() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	dal, handler := suite.newServer(false)
+	id, err := dal.Post(&models.Patient{Gender: "male"})
+	require.NoError(err)
+	suite.interceptor.after = 0
+	suite.interceptor.panicOn = "unknown"
+
+	// The third entry panics, after the first two have been written
+	bundle := fmt.Sprintf(`{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"resource": {"resourceType": "Patient", "gender": "female"},
+			"request": {"method": "POST", "url": "Patient"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "other"},
+			"request": {"method": "PUT", "url": "Patient/%s"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "unknown"},
+			"request": {"method": "POST", "url": "Patient"}
+		}]
+	}`, id)
+	r := httptest.NewRequest("POST", "http://example.com/", bytes.NewBufferString(bundle))
+	r.Header.Set("Content-Type", "application/json")
+	assert.Panics(func() {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	})
+
+	// The panic continues, but only after the entries already written are undone
+	result, err := dal.Get(id, "Patient")
+	require.NoError(err)
+	assert.Equal("male", result.(*models.Patient).Gender)
+	suite.assertCount("patients", 1)
+	assert.Equal(0, suite.interceptor.after)
+	assert.Equal(2, suite.interceptor.onError)
+}
+
+func (suite *TransactionSuite) TestCommit() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	dal, _ := suite.newServer(true)
+	var id string
+	err := dal.Transaction(func(tx server.DataAccessLayer) error {
+		var err error
+		if id, err = tx.Post(&models.Patient{Gender: "male"}); err != nil {
+			return err
+		}
+		_, err = tx.Put(id, &models.Patient{Gender: "female"})
+		return err
+	})
+	require.NoError(err)
+	assert.Equal(2, suite.interceptor.after)
+
+	result, err := dal.Get(id, "Patient")
+	require.NoError(err)
+	assert.Equal("female", result.(*models.Patient).Gender)
+	assert.Equal("2", result.(*models.Patient).Meta.VersionId)
+	suite.assertCount("patients_prev", 1)
+}
+
+func (suite *TransactionSuite) TestConditionalDeleteWithInterceptors() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	// Without history, the interceptors are run on the resources found before they're deleted together
+	dal, _ := suite.newServer(false)
+	for i := 0; i < 3; i++ {
+		_, err := dal.Post(&models.Patient{Gender: "male"})
+		require.NoError(err)
+	}
+	_, err := dal.Post(&models.Patient{Gender: "female"})
+	require.NoError(err)
+	suite.interceptor.after = 0
+
+	// Every matching resource is deleted, not just those on the first page (which has no total)
+	count, err := dal.ConditionalDelete(search.Query{Resource: "Patient", Query: "gender=male&_count=2&_total=none"})
+	require.NoError(err)
+	assert.Equal(3, count)
+	assert.Equal(3, suite.interceptor.after)
+	assert.Equal(0, suite.interceptor.onError)
+	suite.assertCount("patients", 1)
+}
+
+func (suite *TransactionSuite) TestTransactionBundle() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	dal, handler := suite.newServer(false)
+	id, err := dal.Post(&models.Patient{Gender: "male"})
+	require.NoError(err)
+
+	bundle := fmt.Sprintf(`{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [{
+			"fullUrl": "urn:uuid:a",
+			"resource": {"resourceType": "Patient", "gender": "female"},
+			"request": {"method": "POST", "url": "Patient"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "other", "link": [{"other": {"reference": "urn:uuid:a"}, "type": "seealso"}]},
+			"request": {"method": "PUT", "url": "Patient/%s"}
+		}, {
+			"resource": {"resourceType": "Patient", "gender": "unknown"},
+			"request": {"method": "PUT", "url": "Patient/%s", "ifMatch": "W/\"1\""}
+		}]
+	}`, id, id)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/", bytes.NewBufferString(bundle))
+	r.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, r)
+
+	// The last PUT fails, since the resource was updated by the one before it
+	require.Equal(http.StatusPreconditionFailed, w.Code)
+	outcome := new(models.OperationOutcome)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), outcome))
+	require.Len(outcome.Issue, 1)
+	assert.Equal("conflict", outcome.Issue[0].Code)
+	assert.Equal([]string{"Bundle.entry[2]"}, outcome.Issue[0].Location)
+
+	result, err := dal.Get(id, "Patient")
+	require.NoError(err)
+	assert.Equal("male", result.(*models.Patient).Gender)
+	suite.assertCount("patients", 1)
+
+	// Without the failing entry, the transaction succeeds
+	w = httptest.NewRecorder()
+	var request models.Bundle
+	require.NoError(json.Unmarshal([]byte(bundle), &request))
+	request.Entry = request.Entry[:2]
+	body, err := json.Marshal(&request)
+	require.NoError(err)
+	r = httptest.NewRequest("POST", "http://example.com/", bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, r)
+
+	require.Equal(http.StatusOK, w.Code)
+	response := new(models.Bundle)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	assert.Equal("transaction-response", response.Type)
+	suite.assertCount("patients", 2)
+}
+
+func (suite *TransactionSuite) newServer(enableHistory bool) (server.DataAccessLayer, http.Handler) {
+	config := server.DefaultConfig
+	config.EnableHistory = enableHistory
+	interceptors := make(map[string]server.InterceptorList)
+	for _, op := range []string{"Create", "Update", "Delete"} {
+		interceptors[op] = server.InterceptorList{server.Interceptor{ResourceType: "Patient", Handler: suite.interceptor}}
+	}
+	return newTestServer(&suite.MongoSuite, interceptors, config)
+}
+
+func (suite *TransactionSuite) assertCount(collection string, expected int) {
+	n, err := server.Database.C(collection).Count()
+	suite.Require().NoError(err)
+	suite.Assert().Equal(expected, n, collection)
+}
+
+// countingInterceptor counts the number of successful and failed operations it is notified of.  If panicOn is set,
+// it panics before a Patient with that gender is written.
+type countingInterceptor struct {
+	after   int
+	onError int
+	panicOn string
+}
+
+func (i *countingInterceptor) Before(resource interface{}) {
+	if patient, ok := resource.(*models.Patient); ok && i.panicOn != "" && patient.Gender == i.panicOn {
+		panic("interceptor panicked")
+	}
+}
+
+func (i *countingInterceptor) After(resource interface{}) {
+	i.after++
+}
+
+func (i *countingInterceptor) OnError(err error, resource interface{}) {
+	i.onError++
+}
@@ -0,0 +1,195 @@
+package synthma
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/stretchr/testify/suite"
+	"github.com/synthetichealth/gofhir/testutil"
+)
+
+func TestXMLSuite(t *testing.T) {
+	suite.Run(t, new(XMLSuite))
+}
+
+func TestResponseFormatSuite(t *testing.T) {
+	suite.Run(t, new(ResponseFormatSuite))
+}
+
+// ResponseFormatSuite tests choosing the format of responses, which doesn't need a database
+type ResponseFormatSuite struct {
+	suite.Suite
+}
+
+func (suite *ResponseFormatSuite) TestResponseFormat() {
+	tests := []struct {
+		query, accept, expected string
+	}{
+		{"", "", "json"},
+		{"", "application/fhir+json", "json"},
+		{"", "application/json+fhir", "json"},
+		{"", "application/fhir+xml", "xml"},
+		{"", "text/xml", "xml"},
+		{"", "*/*", "json"},
+		{"", "application/fhir+ndjson", "json"},
+		{"", "text/csv", ""},
+		// The most preferred format is chosen, and JSON is preferred when they are equally preferred
+		{"", "application/fhir+xml, application/fhir+json;q=0.9", "xml"},
+		{"", "application/fhir+xml;q=0.5, application/fhir+json;q=0.9", "json"},
+		{"", "application/fhir+xml, application/fhir+json", "json"},
+		{"", "text/csv, application/xml;q=0.1", "xml"},
+		{"", "application/fhir+json;q=0", ""},
+		{"", "APPLICATION/FHIR+XML", "xml"},
+		// The _format parameter overrides the Accept header
+		{"_format=json", "application/fhir+xml", "json"},
+		{"_format=xml", "", "xml"},
+		{"_format=application/fhir%2Bxml", "", "xml"},
+		// An unencoded + in the parameter is decoded as a space
+		{"_format=application/fhir+xml", "", "xml"},
+		{"_format=csv", "application/fhir+json", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/Patient?"+test.query, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		suite.Equal(test.expected, server.ResponseFormat(r), "%s (Accept: %s)", test.query, test.accept)
+	}
+}
+
+type XMLSuite struct {
+	testutil.MongoSuite
+	dal     server.DataAccessLayer
+	handler http.Handler
+}
+
+func (suite *XMLSuite) SetupTest() {
+	suite.dal, suite.handler = newTestServer(&suite.MongoSuite, nil, server.DefaultConfig)
+}
+
+func (suite *XMLSuite) TearDownTest() {
+	suite.TearDownDB()
+}
+
+func (suite *XMLSuite) TearDownSuite() {
+	suite.TearDownDBServer()
+}
+
+const patientXML = `<?xml version="1.0" encoding="UTF-8"?>
+<Patient xmlns="http://hl7.org/fhir">
+  <text>
+    <status value="generated"/>
+    <div xmlns="http://www.w3.org/1999/xhtml">John <b>Doe</b></div>
+  </text>
+  <contained>
+    <Organization>
+      <id value="org"/>
+      <name value="Hospital"/>
+    </Organization>
+  </contained>
+  <extension url="http://example.com/fhir/birthPlace">
+    <valueString value="Boston"/>
+  </extension>
+  <active value="true"/>
+  <name>
+    <family value="Doe"/>
+    <given value="John"/>
+  </name>
+  <gender value="male"/>
+  <birthDate value="1970-01-02"/>
+  <multipleBirthInteger value="2"/>
+  <managingOrganization>
+    <reference value="#org"/>
+  </managingOrganization>
+</Patient>`
+
+func (suite *XMLSuite) TestRoundTrip() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	patient := new(models.Patient)
+	require.NoError(models.UnmarshalResourceXML([]byte(patientXML), patient))
+	assert.Equal("Patient", patient.ResourceType)
+	assert.Equal(`<div xmlns="http://www.w3.org/1999/xhtml">John <b>Doe</b></div>`, patient.Text.Div)
+	require.Len(patient.Contained, 1)
+	assert.Equal("Hospital", patient.Contained[0].(*models.Organization).Name)
+	require.Len(patient.Extension, 1)
+	assert.Equal("http://example.com/fhir/birthPlace", patient.Extension[0].Url)
+	assert.Equal("Boston", patient.Extension[0].ValueString)
+	assert.True(*patient.Active)
+	assert.Equal([]string{"John"}, patient.Name[0].Given)
+	assert.Equal("1970-01-02", patient.BirthDate.Time.Format("2006-01-02"))
+	assert.Equal(int32(2), *patient.MultipleBirthInteger)
+	assert.Equal("#org", patient.ManagingOrganization.Reference)
+
+	data, err := models.MarshalResourceXML(patient)
+	require.NoError(err)
+	roundTripped := new(models.Patient)
+	require.NoError(models.UnmarshalResourceXML(data, roundTripped))
+	assert.Equal(patient, roundTripped)
+
+	// The XML must be of the expected resource type
+	assert.EqualError(models.UnmarshalResourceXML(data, new(models.Condition)), "Expected resourceType to be Condition, instead received Patient")
+}
+
+func (suite *XMLSuite) TestCreateAndRead() {
+	require := suite.Require()
+	assert := suite.Assert()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://example.com/Patient", bytes.NewBufferString(patientXML))
+	r.Header.Set("Content-Type", "application/fhir+xml")
+	r.Header.Set("Accept", "application/fhir+xml")
+	suite.handler.ServeHTTP(w, r)
+	require.Equal(http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal("application/fhir+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	created := new(models.Patient)
+	require.NoError(models.UnmarshalResourceXML(w.Body.Bytes(), created))
+	require.NotEmpty(created.Id)
+	assert.Equal("male", created.Gender)
+
+	// The _format parameter overrides the Accept header
+	w = suite.get("/Patient/"+created.Id+"?_format=json", "application/fhir+xml")
+	require.Equal(http.StatusOK, w.Code)
+	read := new(models.Patient)
+	require.NoError(json.Unmarshal(w.Body.Bytes(), read))
+	assert.Equal("Hospital", read.Contained[0].(*models.Organization).Name)
+
+	// Searches respond with XML bundles too
+	w = suite.get("/Patient?gender=male&_format=xml", "")
+	require.Equal(http.StatusOK, w.Code)
+	assert.True(strings.HasPrefix(w.Header().Get("Content-Type"), "application/fhir+xml"))
+	bundle := new(models.Bundle)
+	require.NoError(models.UnmarshalResourceXML(w.Body.Bytes(), bundle))
+	require.Len(bundle.Entry, 1)
+	assert.Equal(created.Id, bundle.Entry[0].Resource.(*models.Patient).Id)
+
+	// JSON is preferred when both are acceptable
+	w = suite.get("/Patient/"+created.Id, "application/fhir+xml;q=0.9, */*;q=0.8, application/fhir+json")
+	assert.True(strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"))
+}
+
+func (suite *XMLSuite) TestNotAcceptable() {
+	assert := suite.Assert()
+
+	assert.Equal(http.StatusNotAcceptable, suite.get("/Patient", "text/csv").Code)
+	assert.Equal(http.StatusNotAcceptable, suite.get("/Patient?_format=csv", "").Code)
+	assert.Equal(http.StatusOK, suite.get("/Patient", "text/csv, application/xml;q=0.1").Code)
+}
+
+func (suite *XMLSuite) get(path, accept string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	suite.handler.ServeHTTP(w, r)
+	return w
+}